@@ -5,12 +5,17 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+
+	"github.com/dacort/choirmaster/notetext"
 )
 
 const choirSingUrl = "http://api.choir.io/%s"
 
 type Choir struct {
 	Key string
+
+	// Format is the markup the choir renders note text with
+	Format notetext.Format
 }
 
 type Note struct {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 
 	"github.com/dacort/choirmaster/choir"
@@ -12,6 +13,10 @@ import (
 
 type Config struct {
 	Sources []map[string]interface{}
+	Inbound struct {
+		Listen string
+	}
+	Checkpoints string
 }
 
 func getConfig(filename string) *Config {
@@ -32,6 +37,11 @@ func main() {
 	// Read in the config file and then FindService(type) and Configure(config_item)
 	config := getConfig("config.json")
 
+	// Sources pick up where they left off from here
+	if err := ensemble.OpenCheckpoints(config.Checkpoints); err != nil {
+		log.Fatalf("ERR opening checkpoints: %s", err)
+	}
+
 	// Now, create a channel to listen on.
 	// Each time a service gets updated, this channel gets called
 	var conductorChan = make(chan *choir.Note)
@@ -45,6 +55,13 @@ func main() {
 		}
 	}
 
+	// Webhook style sources all share one listener
+	if ensemble.HasInbound() {
+		go func() {
+			log.Fatal(ensemble.ServeInbound(config.Inbound.Listen))
+		}()
+	}
+
 	// Let's make this sucker sing!
 	for {
 		b := <-conductorChan
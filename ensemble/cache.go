@@ -0,0 +1,109 @@
+package ensemble
+
+import (
+	"sync"
+	"time"
+)
+
+// NameCache remembers names (users, groups, rooms) looked up from a remote
+// API for a while. It's safe to share between goroutines, and concurrent
+// lookups of the same key share a single request.
+type NameCache struct {
+	TTL time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]cachedName
+	inflight map[string]*nameLookup
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+type nameLookup struct {
+	done chan struct{}
+	name string
+	err  error
+}
+
+func NewNameCache(ttl time.Duration) *NameCache {
+	return &NameCache{
+		TTL:      ttl,
+		entries:  make(map[string]cachedName),
+		inflight: make(map[string]*nameLookup),
+	}
+}
+
+// Get returns the cached name for key, calling load to fetch it if it's
+// missing or expired. Failed lookups aren't cached.
+func (c *NameCache) Get(key string, load func() (string, error)) (string, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.name, nil
+	}
+
+	// Someone else is already asking, wait for their answer
+	if l, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-l.done
+		return l.name, l.err
+	}
+
+	l := &nameLookup{done: make(chan struct{})}
+	c.inflight[key] = l
+	c.mu.Unlock()
+
+	l.name, l.err = load()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if l.err == nil {
+		c.entries[key] = cachedName{name: l.name, expires: time.Now().Add(c.TTL)}
+	}
+	c.mu.Unlock()
+	close(l.done)
+
+	return l.name, l.err
+}
+
+// Set stores a name we learned some other way.
+func (c *NameCache) Set(key, name string) {
+	c.mu.Lock()
+	c.entries[key] = cachedName{name: name, expires: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+}
+
+// RecentSet remembers the last Size keys it was given, so sources can skip
+// deliveries and entries they've already sung about.
+type RecentSet struct {
+	Size int
+
+	mu    sync.Mutex
+	keys  map[string]bool
+	order []string
+}
+
+func NewRecentSet(size int) *RecentSet {
+	return &RecentSet{Size: size, keys: make(map[string]bool)}
+}
+
+// Add records key and reports whether it's new.
+func (r *RecentSet) Add(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.keys[key] {
+		return false
+	}
+
+	r.keys[key] = true
+	r.order = append(r.order, key)
+	if len(r.order) > r.Size {
+		delete(r.keys, r.order[0])
+		r.order = r.order[1:]
+	}
+
+	return true
+}
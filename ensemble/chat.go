@@ -0,0 +1,122 @@
+package ensemble
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// How many speakers are named in an activity note before the rest are
+// just counted
+const chatNamedSpeakers = 3
+
+// chatNote is a line said in a chat room, e.g. "(#general) alice: hi".
+// Actions read "(#general) * alice waves".
+func chatNote(source, room, speaker, text string, action bool, c *choir.Choir) *choir.Note {
+	line := fmt.Sprintf("(%s) %s: %s", room, speaker, notetext.Clean(text, 500))
+	if action {
+		line = fmt.Sprintf("(%s) * %s %s", room, speaker, notetext.Clean(text, 500))
+	}
+
+	return &choir.Note{
+		Label: fmt.Sprintf("%s:%s", source, room),
+		Sound: "n/0",
+		Text:  notetext.Render(line, c.Format),
+		Choir: c,
+	}
+}
+
+// ChatActivity counts messages and speakers in each room, so chat sources
+// can sing how busy each room has been every so often instead of, or as
+// well as, every line.
+type ChatActivity struct {
+	Source string
+	Every  time.Duration
+	Choir  *choir.Choir
+
+	mu    sync.Mutex
+	rooms map[string]*roomActivity
+}
+
+type roomActivity struct {
+	messages int
+	speakers []string
+}
+
+func NewChatActivity(source string, every time.Duration, c *choir.Choir) *ChatActivity {
+	return &ChatActivity{Source: source, Every: every, Choir: c, rooms: make(map[string]*roomActivity)}
+}
+
+// Count records that speaker said something in room.
+func (a *ChatActivity) Count(room, speaker string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, ok := a.rooms[room]
+	if !ok {
+		r = &roomActivity{}
+		a.rooms[room] = r
+	}
+	r.messages++
+	if !containsString(r.speakers, speaker) {
+		r.speakers = append(r.speakers, speaker)
+	}
+}
+
+// Notes returns a note for every room that's been talking since the last
+// call and starts counting again. The more people talking, the louder.
+func (a *ChatActivity) Notes() []*choir.Note {
+	a.mu.Lock()
+	rooms := a.rooms
+	a.rooms = make(map[string]*roomActivity)
+	a.mu.Unlock()
+
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	notes := make([]*choir.Note, 0, len(names))
+	for _, name := range names {
+		r := rooms[name]
+
+		speakers := r.speakers
+		if len(speakers) > chatNamedSpeakers+1 {
+			others := len(speakers) - chatNamedSpeakers
+			speakers = append(speakers[:chatNamedSpeakers:chatNamedSpeakers], fmt.Sprintf("%d others", others))
+		}
+
+		level := len(r.speakers) / 3
+		if level > 2 {
+			level = 2
+		}
+
+		messages := "messages"
+		if r.messages == 1 {
+			messages = "message"
+		}
+
+		notes = append(notes, &choir.Note{
+			Label: fmt.Sprintf("%s:%s", a.Source, name),
+			Sound: fmt.Sprintf("n/%d", level),
+			Text:  notetext.Render(fmt.Sprintf("(%s) %d %s from %s", name, r.messages, messages, joinList(speakers)), a.Choir.Format),
+			Choir: a.Choir,
+		})
+	}
+
+	return notes
+}
+
+// Sing sends the counts to the conductor every Every, forever.
+func (a *ChatActivity) Sing(conductor chan *choir.Note) {
+	for range time.Tick(a.Every) {
+		for _, note := range a.Notes() {
+			conductor <- note
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Where checkpoints are kept unless configured otherwise
+const DefaultCheckpointPath = "checkpoints.json"
+
+// CheckpointStore remembers where sources got to, like a file offset or a
+// sync token, so a restart neither repeats nor skips events. Everything is
+// kept in one JSON file, keyed by source.
+type CheckpointStore struct {
+	Path string
+
+	mu     sync.Mutex
+	values map[string]json.RawMessage
+}
+
+// Checkpoints is the store every source shares.
+var Checkpoints = &CheckpointStore{Path: DefaultCheckpointPath, values: map[string]json.RawMessage{}}
+
+// OpenCheckpoints points the shared store at path and loads what's there.
+// A missing file is just an empty store.
+func OpenCheckpoints(path string) error {
+	if path == "" {
+		path = DefaultCheckpointPath
+	}
+
+	Checkpoints.mu.Lock()
+	defer Checkpoints.mu.Unlock()
+
+	Checkpoints.Path = path
+	Checkpoints.values = map[string]json.RawMessage{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &Checkpoints.values)
+}
+
+// Load decodes the checkpoint saved under key into v, reporting whether
+// there was one.
+func (cs *CheckpointStore) Load(key string, v interface{}) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	raw, ok := cs.values[key]
+	if !ok {
+		return false
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		log.Printf("ERR reading checkpoint %s: %s", key, err)
+		return false
+	}
+	return true
+}
+
+// Save stores v under key and writes the store out.
+func (cs *CheckpointStore) Save(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.values[key] = raw
+
+	data, err := json.MarshalIndent(cs.values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash can't leave half a file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(cs.Path), ".checkpoints")
+	if err != nil {
+		log.Printf("ERR saving checkpoint %s: %s", key, err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cs.Path)
+	}
+	if err != nil {
+		log.Printf("ERR saving checkpoint %s: %s", key, err)
+	}
+	return err
+}
@@ -9,11 +9,23 @@ type Servicer interface {
 
 var services = map[string]Servicer{}
 
+// Generic sources can be configured any number of times, so they register
+// a function that makes a fresh one for each config entry.
+var factories = map[string]func() Servicer{}
+
 func RegisterService(name string, service Servicer) {
 	services[name] = service
 }
 
+func RegisterFactory(name string, factory func() Servicer) {
+	factories[name] = factory
+}
+
 func FindService(name string) (s Servicer, ok bool) {
+	if factory, found := factories[name]; found {
+		return factory(), true
+	}
+
 	s, ok = services[name]
 	return
 }
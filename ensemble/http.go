@@ -0,0 +1,204 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// Longest response body we'll read from a polled API
+const maxResponseBytes = 10 << 20
+
+// How much of a bad response body makes it into the log
+const responseSnippetLength = 200
+
+// Polling never backs off further than this
+const maxBackoff = 10 * time.Minute
+
+// StatusError is returned when a remote API answers with anything but 2xx.
+type StatusError struct {
+	Source string
+	Url    string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s for %s", e.Source, e.Code, http.StatusText(e.Code), e.Url)
+}
+
+// Unauthorized is true when our credentials were rejected.
+func (e *StatusError) Unauthorized() bool {
+	return e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden
+}
+
+// Temporary is true when the remote end is struggling and we should back off.
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+// CheckResponse returns a StatusError if resp isn't a 2xx, logging a snippet
+// of the body to help work out what went wrong.
+func CheckResponse(source string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err := &StatusError{Source: source, Url: redactURL(resp.Request.URL), Code: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, responseSnippetLength*4))
+	log.Printf("ERR %s: %s", err, snippet(body))
+
+	return err
+}
+
+// redactURL makes a URL safe to log. Tokens are as likely to be in the
+// query string as the userinfo, so every query value is hidden.
+func redactURL(u *url.URL) string {
+	safe := *u
+	safe.User = nil
+	if query := safe.Query(); len(query) > 0 {
+		for key, values := range query {
+			for i := range values {
+				values[i] = "xxxxx"
+			}
+			query[key] = values
+		}
+		safe.RawQuery = query.Encode()
+	}
+	return safe.String()
+}
+
+// FetchJSON makes the request and decodes the JSON response into v. Numbers
+// decoded into interface{} values keep their exact text as json.Number.
+func FetchJSON(source string, client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("ERR making request for %s: %s", source, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return decodeBody(source, "json", resp, v, unmarshalNumbers)
+}
+
+func unmarshalNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// DecodeJSON checks the response status and decodes its JSON body into v.
+func DecodeJSON(source string, resp *http.Response, v interface{}) error {
+	return decodeBody(source, "json", resp, v, json.Unmarshal)
+}
+
+// DecodeXML checks the response status and decodes its XML body into v.
+func DecodeXML(source string, resp *http.Response, v interface{}) error {
+	return decodeBody(source, "xml", resp, v, xml.Unmarshal)
+}
+
+func decodeBody(source, kind string, resp *http.Response, v interface{}, unmarshal func([]byte, interface{}) error) error {
+	if err := CheckResponse(source, resp); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		log.Printf("ERR reading response from %s: %s", source, err)
+		return err
+	}
+
+	if err := unmarshal(body, v); err != nil {
+		log.Printf("ERR decoding %s from %s: %s\n%s", kind, source, err, snippet(body))
+		return err
+	}
+
+	return nil
+}
+
+// snippet makes a short, single line version of a response body for logs.
+func snippet(body []byte) string {
+	text := notetext.Collapse(string(bytes.ToValidUTF8(body, []byte("?"))))
+	return notetext.Truncate(text, responseSnippetLength)
+}
+
+// SourceHealth keeps track of how a polling source's requests are going. It
+// backs off while the remote end is failing and sings once when our
+// credentials stop working, rather than on every poll.
+type SourceHealth struct {
+	Name  string
+	Choir *choir.Choir
+
+	Unauthenticated bool
+	Failures        int
+}
+
+// Observe records the outcome of a poll and returns how long to wait before
+// polling again.
+func (h *SourceHealth) Observe(err error, interval time.Duration, conductor chan *choir.Note) time.Duration {
+	if err == nil {
+		if h.Unauthenticated {
+			log.Printf("%s is authenticated again", h.Name)
+		}
+		h.Unauthenticated = false
+		h.Failures = 0
+		return interval
+	}
+
+	statusErr, isStatus := err.(*StatusError)
+
+	switch {
+	case isStatus && statusErr.Unauthorized():
+		if !h.Unauthenticated {
+			h.Unauthenticated = true
+			h.alert("Choirmaster:auth", fmt.Sprintf("%s source auth failed (%d)", h.Name, statusErr.Code), conductor)
+		}
+		return h.backoff(interval)
+	case isStatus && !statusErr.Temporary():
+		// The request itself is wrong, trying harder won't help
+		return interval
+	default:
+		// Server errors and network trouble
+		return h.backoff(interval)
+	}
+}
+
+// Report sings about something wrong with the source that retrying won't
+// fix, so it's heard and not just logged.
+func (h *SourceHealth) Report(problem string, conductor chan *choir.Note) {
+	h.alert("Choirmaster:error", fmt.Sprintf("%s source %s", h.Name, problem), conductor)
+}
+
+func (h *SourceHealth) alert(label string, text string, conductor chan *choir.Note) {
+	note := &choir.Note{
+		Label: label,
+		Sound: "b/3",
+		Text:  notetext.Render(text, h.Choir.Format),
+		Choir: h.Choir,
+	}
+	go func() {
+		conductor <- note
+	}()
+}
+
+func (h *SourceHealth) backoff(interval time.Duration) time.Duration {
+	if h.Failures < 16 {
+		h.Failures++
+	}
+
+	wait := interval << uint(h.Failures)
+	if wait > maxBackoff || wait <= 0 {
+		wait = maxBackoff
+	}
+
+	log.Printf("%s backing off for %s", h.Name, wait)
+	return wait
+}
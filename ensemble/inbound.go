@@ -0,0 +1,120 @@
+package ensemble
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Address the inbound server listens on unless configured otherwise
+const DefaultInboundListen = ":8088"
+
+// Biggest request body an inbound source will accept
+const maxInboundBytes = 5 << 20
+
+// Sources that are sent events rather than polling for them share a single
+// HTTP listener, each handling its own path.
+var (
+	inbound      = http.NewServeMux()
+	inboundPaths = map[string]string{}
+	inboundMu    sync.Mutex
+)
+
+// HandleInbound registers handler for path on the shared inbound server.
+// The name of the source is only used for logging.
+func HandleInbound(name string, path string, handler http.Handler) {
+	inboundMu.Lock()
+	defer inboundMu.Unlock()
+
+	if owner, ok := inboundPaths[path]; ok {
+		log.Printf("ERR inbound path %s is already used by %s, not adding %s", path, owner, name)
+		return
+	}
+
+	inboundPaths[path] = name
+	inbound.Handle(path, handler)
+	log.Printf("Listening for %s on %s", name, path)
+}
+
+// HasInbound reports whether any source wants the inbound server.
+func HasInbound() bool {
+	inboundMu.Lock()
+	defer inboundMu.Unlock()
+
+	return len(inboundPaths) > 0
+}
+
+// ServeInbound runs the shared inbound server. It only returns on error.
+func ServeInbound(addr string) error {
+	if addr == "" {
+		addr = DefaultInboundListen
+	}
+
+	log.Printf("Inbound server listening on %s", addr)
+	return http.ListenAndServe(addr, inbound)
+}
+
+// ReadInbound reads a request body, refusing anything larger than we'd
+// ever expect a webhook to send.
+func ReadInbound(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInboundBytes))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// ValidHMAC checks a hex encoded HMAC-SHA256 signature of body, with or
+// without a "sha256=" prefix.
+func ValidHMAC(secret string, body []byte, signature string) bool {
+	given, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+	if err != nil || secret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// ValidHMACBase64 is ValidHMAC for senders that base64 encode the signature.
+func ValidHMACBase64(secret string, body []byte, signature string) bool {
+	given, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(signature), "sha256="))
+	if err != nil || secret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(given, mac.Sum(nil))
+}
+
+// ValidToken compares a shared secret without leaking how much of it matched.
+func ValidToken(expected, given string) bool {
+	return expected != "" && hmac.Equal([]byte(expected), []byte(given))
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header, or
+// from the token query parameter for senders that can't set headers.
+func BearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package ensemble
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileId identifies the file behind a path, so we notice when a log is
+// rotated out from under us.
+func fileId(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
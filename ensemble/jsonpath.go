@@ -0,0 +1,96 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LookupPath finds a value in decoded JSON by a dotted path like
+// "data.items", "items[0].id" or "items.0.id". An empty path or "$" is the
+// value itself.
+func LookupPath(value interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return value, true
+	}
+
+	path = strings.Replace(strings.Replace(path, "[", ".", -1), "]", "", -1)
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			continue
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			found, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			value = found
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// LookupString is LookupPath for values we want as text. Numbers keep
+// their JSON form, so ids don't turn into 1.2e+06.
+func LookupString(value interface{}, path string) string {
+	found, ok := LookupPath(value, path)
+	if !ok || found == nil {
+		return ""
+	}
+
+	switch v := found.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// ParseTimestamp reads the timestamps APIs tend to use: RFC 3339, the given
+// layout, or seconds (or milliseconds) since the epoch.
+func ParseTimestamp(value string, layout string) (time.Time, error) {
+	if layout != "" {
+		return time.Parse(layout, value)
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		// Nothing sends seconds this far in the future, they're milliseconds
+		if seconds > 1e11 {
+			seconds /= 1000
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, "2006-01-02 15:04:05", "2006/01/02 15:04:05 -0700"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unknown timestamp format %q", value)
+}
@@ -0,0 +1,217 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// How loud a firing alert is for each value of its severity label
+var alertmanagerSeverities = map[string]int{
+	"critical": 3,
+	"page":     3,
+	"error":    2,
+	"high":     2,
+	"warning":  1,
+	"medium":   1,
+	"low":      0,
+	"info":     0,
+}
+
+// Alertmanager receives Prometheus Alertmanager webhook notifications.
+type Alertmanager struct {
+	Path       string
+	Token      string
+	Severities map[string]int
+	Choir      *choir.Choir
+	Notes      chan *choir.Note
+	Alerts     *RecentSet
+}
+
+type AlertmanagerConfig struct {
+	Type       string
+	Key        string
+	Format     string
+	Path       string
+	Token      string
+	Severities map[string]int
+}
+
+type AlertmanagerPayload struct {
+	Version  string
+	GroupKey string
+	Status   string
+	Receiver string
+	Alerts   []Alert
+}
+
+type Alert struct {
+	Status       string
+	Labels       map[string]string
+	Annotations  map[string]string
+	StartsAt     string
+	EndsAt       string
+	GeneratorURL string
+	Fingerprint  string
+}
+
+func (am *Alertmanager) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject AlertmanagerConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	am.Path = configObject.Path
+	if am.Path == "" {
+		am.Path = "/alertmanager"
+	}
+	am.Token = configObject.Token
+
+	am.Severities = make(map[string]int)
+	for name, level := range alertmanagerSeverities {
+		am.Severities[name] = level
+	}
+	for name, level := range configObject.Severities {
+		am.Severities[strings.ToLower(name)] = level
+	}
+
+	am.Choir = choir.NewChoir(configObject.Key)
+	am.Choir.Format = notetext.ParseFormat(configObject.Format)
+	am.Notes = make(chan *choir.Note, 100)
+	am.Alerts = NewRecentSet(5000)
+
+	HandleInbound("Alertmanager", am.Path, am)
+
+	fmt.Printf("Configured Alertmanager: %s\n", am.Path)
+}
+
+// Id is the alert's fingerprint. Alertmanager has sent one since 0.19, for
+// older versions we make our own from the labels.
+func (a *Alert) Id() string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+
+	names := make([]string, 0, len(a.Labels))
+	for name := range a.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+a.Labels[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Summary is the best description the alert has of itself.
+func (a *Alert) Summary() string {
+	for _, name := range []string{"summary", "description", "message"} {
+		if text := a.Annotations[name]; text != "" {
+			return text
+		}
+	}
+	return a.Labels["alertname"]
+}
+
+// Level is how loud the alert is when it fires, 0 to 3. Numeric severity
+// labels are used as they are.
+func (am *Alertmanager) Level(a *Alert) int {
+	severity := strings.ToLower(a.Labels["severity"])
+
+	level, ok := am.Severities[severity]
+	if !ok {
+		var err error
+		if level, err = strconv.Atoi(severity); err != nil {
+			level = 1
+		}
+	}
+
+	if level < 0 {
+		return 0
+	} else if level > 3 {
+		return 3
+	}
+	return level
+}
+
+// BuildNote returns nil for an alert we've already sung in this state.
+// Alertmanager repeats every alert in a group each time it notifies about
+// the group, and a resolved alert stays in the group for a while.
+func (am *Alertmanager) BuildNote(a *Alert) *choir.Note {
+	if !am.Alerts.Add(strings.Join([]string{a.Id(), a.Status, a.StartsAt}, "|")) {
+		return nil
+	}
+
+	name := a.Labels["alertname"]
+	text := notetext.Clean(a.Summary(), 500)
+	if instance := a.Labels["instance"]; instance != "" && !strings.Contains(text, instance) {
+		text = fmt.Sprintf("%s (%s)", text, instance)
+	}
+
+	var sound string
+	switch a.Status {
+	case "firing":
+		sound = fmt.Sprintf("b/%d", am.Level(a))
+	case "resolved":
+		sound = "g/1"
+		text = "Resolved: " + text
+	default:
+		return nil
+	}
+
+	return &choir.Note{
+		Label: fmt.Sprintf("Alert:%s", name),
+		Sound: sound,
+		Text:  notetext.Render(text, am.Choir.Format),
+		Choir: am.Choir,
+	}
+}
+
+func (am *Alertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := ReadInbound(w, r)
+	if !ok {
+		return
+	}
+
+	if am.Token != "" && !ValidToken(am.Token, BearerToken(r)) {
+		log.Printf("ERR Alertmanager webhook with a bad token from %s", r.RemoteAddr)
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+
+	var payload AlertmanagerPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("ERR decoding Alertmanager webhook: %s", err)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	for i := range payload.Alerts {
+		if note := am.BuildNote(&payload.Alerts[i]); note != nil {
+			am.Notes <- note
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (am *Alertmanager) Run(conductor chan *choir.Note) {
+	for note := range am.Notes {
+		conductor <- note
+	}
+}
+
+func init() {
+	fmt.Println("Registered Alertmanager")
+	RegisterFactory("alertmanager", func() Servicer { return &Alertmanager{} })
+}
@@ -17,6 +17,7 @@ type Campfire struct {
 	Orgname string
 	Token   string
 	Choir   *choir.Choir
+	Health  SourceHealth
 
 	Rooms map[int]string
 	Users map[int]string
@@ -64,23 +65,24 @@ func (c *Campfire) GetUser(id int) string {
 	userUrl := fmt.Sprintf("https://%s.campfirenow.com/users/%d.json", c.Orgname, id)
 	req, err := http.NewRequest("GET", userUrl, nil)
 	if err != nil {
-		log.Fatalf("error building request: %s", err)
+		log.Printf("ERR building request: %s", err)
+		return fmt.Sprintf("%d", id)
 	}
 
 	req.SetBasicAuth(c.Token, "x")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("error making request: %s", err)
+		log.Printf("ERR looking up user %d on Campfire: %s", id, err)
+		return fmt.Sprintf("%d", id)
 	}
 
+	defer resp.Body.Close()
+
 	var user UserResponse
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&user)
-	if err != nil {
+	if err := DecodeJSON("Campfire", resp, &user); err != nil {
 		return fmt.Sprintf("%d", id)
 	}
-	resp.Body.Close()
 
 	c.Users[id] = user.User.Name
 	return user.User.Name
@@ -95,23 +97,24 @@ func (c *Campfire) GetRoom(id int) string {
 	roomUrl := fmt.Sprintf("https://%s.campfirenow.com/room/%d.json", c.Orgname, id)
 	req, err := http.NewRequest("GET", roomUrl, nil)
 	if err != nil {
-		log.Fatalf("error building request: %s", err)
+		log.Printf("ERR building request: %s", err)
+		return fmt.Sprintf("%d", id)
 	}
 
 	req.SetBasicAuth(c.Token, "x")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("error making request: %s", err)
+		log.Printf("ERR looking up room %d on Campfire: %s", id, err)
+		return fmt.Sprintf("%d", id)
 	}
 
+	defer resp.Body.Close()
+
 	var room RoomResponse
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&room)
-	if err != nil {
+	if err := DecodeJSON("Campfire", resp, &room); err != nil {
 		return fmt.Sprintf("%d", id)
 	}
-	resp.Body.Close()
 
 	c.Rooms[id] = room.Room.Name
 	return room.Room.Name
@@ -128,6 +131,8 @@ func (c *Campfire) Configure(config interface{}) {
 	c.Url = fmt.Sprintf("https://streaming.campfirenow.com/room/%d/live.json", configObject.Rooms[0])
 	c.Token = configObject.Token
 	c.Orgname = configObject.Orgname
+	c.Choir = choir.NewChoir(configObject.Key)
+	c.Health = SourceHealth{Name: "Campfire", Choir: c.Choir}
 
 	c.Rooms = make(map[int]string)
 	c.Users = make(map[int]string)
@@ -135,20 +140,28 @@ func (c *Campfire) Configure(config interface{}) {
 	fmt.Printf("Configured Campfire: %d\n", configObject.Rooms[0])
 }
 
-func (c *Campfire) Run(conductor chan *choir.Note) {
+// Stream listens to the room until the connection breaks, returning why.
+func (c *Campfire) Stream(conductor chan *choir.Note) error {
 	req, err := http.NewRequest("GET", c.Url, nil)
 	if err != nil {
-		log.Fatalf("error building request: %s", err)
+		log.Printf("ERR building request: %s", err)
+		return err
 	}
 
 	req.SetBasicAuth(c.Token, "x")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("error making campfire request: %s", err)
+		log.Printf("ERR making campfire request: %s", err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	if err := CheckResponse("Campfire", resp); err != nil {
+		return err
+	}
+	c.Health.Observe(nil, 0, conductor)
+
 	var reader *bufio.Reader
 	reader = bufio.NewReader(resp.Body)
 
@@ -156,7 +169,7 @@ func (c *Campfire) Run(conductor chan *choir.Note) {
 		line, err := reader.ReadBytes('}')
 		if err != nil {
 			fmt.Println("campfire connection broken :(", err)
-			break
+			return err
 		}
 
 		line = bytes.TrimSpace(line)
@@ -177,6 +190,13 @@ func (c *Campfire) Run(conductor chan *choir.Note) {
 	}
 }
 
+func (c *Campfire) Run(conductor chan *choir.Note) {
+	for {
+		err := c.Stream(conductor)
+		time.Sleep(c.Health.Observe(err, 10*time.Second, conductor))
+	}
+}
+
 func init() {
 	fmt.Println("Registered Campfire")
 	RegisterService("campfire", &Campfire{})
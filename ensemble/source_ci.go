@@ -0,0 +1,348 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const ciDefaultInterval = 60 * time.Second
+
+// How deep into Jenkins folders we look for jobs, unless configured
+const jenkinsDefaultDepth = 3
+
+// CI watches builds on Jenkins or GitHub Actions and sings when a job
+// breaks or is fixed. A job that keeps failing stays quiet.
+type CI struct {
+	Name     string
+	Backend  string
+	Url      string
+	Username string
+	Token    string
+	Jobs     []string
+	Branches []string
+	Depth    int
+	Interval time.Duration
+	Client   *http.Client
+	Sounds   CISounds
+	Choir    *choir.Choir
+	Health   SourceHealth
+
+	// Last build we saw of each job on each branch
+	States map[string]CIState
+
+	// GitHub Actions backend, see source_ci_actions.go
+	Repos []string
+}
+
+type CISounds struct {
+	Broken string
+	Fixed  string
+}
+
+type CIConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Name     string
+	Backend  string
+	Url      string
+	Username string
+	Token    string
+	Jobs     []string
+	Branches []string
+	Repos    []string
+	Depth    int
+	Interval int
+	Sounds   CISounds
+}
+
+// CIBuild is a finished build from either backend.
+type CIBuild struct {
+	Job      string
+	Branch   string
+	Number   int64
+	Url      string
+	Passed   bool
+	Duration time.Duration
+
+	// Increases with every build of the job, including reruns
+	Order int64
+}
+
+type CIState struct {
+	Order  int64
+	Passed bool
+}
+
+// Jenkins JSON API
+type JenkinsJob struct {
+	Class              string `json:"_class"`
+	Name               string
+	FullName           string
+	LastCompletedBuild *JenkinsBuild
+	Jobs               []JenkinsJob
+}
+
+type JenkinsBuild struct {
+	Number   int64
+	Result   string
+	Duration int64
+	Url      string
+}
+
+func (ci *CI) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject CIConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	ci.Backend = strings.ToLower(configObject.Backend)
+	switch ci.Backend {
+	case "jenkins":
+		if configObject.Url == "" {
+			log.Printf("ERR ci source with the jenkins backend needs a url")
+			return
+		}
+	case "github_actions":
+		if len(configObject.Repos) == 0 {
+			log.Printf("ERR ci source with the github_actions backend needs repos")
+			return
+		}
+	default:
+		log.Printf("ERR ci source needs a backend, jenkins or github_actions")
+		ci.Backend = ""
+		return
+	}
+
+	ci.Url = strings.TrimSuffix(configObject.Url, "/")
+	ci.Username = configObject.Username
+	ci.Token = configObject.Token
+	ci.Jobs = configObject.Jobs
+	ci.Branches = configObject.Branches
+	ci.Repos = configObject.Repos
+	ci.Depth = configObject.Depth
+	if ci.Depth <= 0 {
+		ci.Depth = jenkinsDefaultDepth
+	}
+	ci.Interval = time.Duration(configObject.Interval) * time.Second
+	if ci.Interval <= 0 {
+		ci.Interval = ciDefaultInterval
+	}
+	ci.Client = &http.Client{Timeout: 30 * time.Second}
+
+	ci.Name = configObject.Name
+	if ci.Name == "" {
+		ci.Name = ci.Backend
+	}
+	ci.Sounds = configObject.Sounds
+	ci.Sounds.Broken = pickString(ci.Sounds.Broken, "b/2")
+	ci.Sounds.Fixed = pickString(ci.Sounds.Fixed, "g/2")
+
+	ci.Choir = choir.NewChoir(configObject.Key)
+	ci.Choir.Format = notetext.ParseFormat(configObject.Format)
+	ci.Health = SourceHealth{Name: ci.Name, Choir: ci.Choir}
+
+	fmt.Printf("Configured CI: %s\n", ci.Name)
+}
+
+// checkpointKey is unique to what the source watches, so two sources with
+// the default name don't overwrite each other's builds.
+func (ci *CI) checkpointKey() string {
+	watched := ci.Url
+	if ci.Backend == "github_actions" {
+		watched = strings.Join(ci.Repos, ",")
+	}
+	return fmt.Sprintf("ci:%s:%s:%s", ci.Name, watched, strings.Join(ci.Jobs, ","))
+}
+
+// Wanted reports whether the job and branch pass the configured filters.
+// Jobs are matched as globs, e.g. "deploy/*".
+func (ci *CI) Wanted(build CIBuild) bool {
+	if len(ci.Branches) > 0 && build.Branch != "" && !containsString(ci.Branches, build.Branch) {
+		return false
+	}
+
+	if len(ci.Jobs) == 0 {
+		return true
+	}
+	for _, pattern := range ci.Jobs {
+		if matched, _ := path.Match(pattern, build.Job); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe records the build and returns a note if it broke or fixed its
+// job. The first build we see of a job only tells us where it stands.
+func (ci *CI) Observe(build CIBuild) *choir.Note {
+	key := build.Job
+	if build.Branch != "" {
+		key = fmt.Sprintf("%s@%s", build.Job, build.Branch)
+	}
+
+	last, seen := ci.States[key]
+	if seen && build.Order <= last.Order {
+		return nil
+	}
+	ci.States[key] = CIState{Order: build.Order, Passed: build.Passed}
+
+	if !seen || build.Passed == last.Passed {
+		return nil
+	}
+
+	label, sound, verb := "broken", ci.Sounds.Broken, "failed"
+	if build.Passed {
+		label, sound, verb = "fixed", ci.Sounds.Fixed, "fixed"
+	}
+
+	title := fmt.Sprintf("%s #%d %s", build.Job, build.Number, verb)
+	if build.Branch != "" {
+		title = fmt.Sprintf("%s on %s", title, build.Branch)
+	}
+	if build.Duration > 0 {
+		title = fmt.Sprintf("%s after %s", title, build.Duration.Round(time.Second))
+	}
+
+	lines := []string{title}
+	if build.Url != "" {
+		lines = append(lines, build.Url)
+	}
+
+	return &choir.Note{
+		Label: fmt.Sprintf("CI:%s", label),
+		Sound: sound,
+		Text:  notetext.Join(lines, ci.Choir.Format),
+		Choir: ci.Choir,
+	}
+}
+
+// FetchBuilds returns the latest finished builds from the backend.
+func (ci *CI) FetchBuilds() ([]CIBuild, error) {
+	if ci.Backend == "github_actions" {
+		return ci.FetchActions()
+	}
+	return ci.FetchJenkins()
+}
+
+// jenkinsTree asks for just the fields we use, depth folders deep.
+func jenkinsTree(depth int) string {
+	fields := "_class,name,fullName,lastCompletedBuild[number,result,duration,url]"
+	if depth > 1 {
+		fields += ",jobs[" + jenkinsTree(depth-1) + "]"
+	}
+	return fields
+}
+
+func (ci *CI) FetchJenkins() (builds []CIBuild, err error) {
+	query := url.Values{"tree": {"jobs[" + jenkinsTree(ci.Depth) + "]"}}
+	req, err := http.NewRequest("GET", ci.Url+"/api/json?"+query.Encode(), nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return
+	}
+	if ci.Username != "" {
+		req.SetBasicAuth(ci.Username, ci.Token)
+	}
+
+	var root JenkinsJob
+	if err = FetchJSON(ci.Name, ci.Client, req, &root); err != nil {
+		return
+	}
+
+	return jenkinsBuilds(root.Jobs, nil), nil
+}
+
+// jenkinsBuilds walks the job tree. The jobs in a multibranch pipeline are
+// its branches, so they're reported as branches of the pipeline.
+func jenkinsBuilds(jobs []JenkinsJob, parent *JenkinsJob) []CIBuild {
+	builds := make([]CIBuild, 0)
+
+	for i := range jobs {
+		job := &jobs[i]
+		builds = append(builds, jenkinsBuilds(job.Jobs, job)...)
+
+		b := job.LastCompletedBuild
+		if b == nil {
+			continue
+		}
+
+		build := CIBuild{
+			Job:      pickString(job.FullName, job.Name),
+			Number:   b.Number,
+			Order:    b.Number,
+			Url:      b.Url,
+			Duration: time.Duration(b.Duration) * time.Millisecond,
+		}
+		if parent != nil && strings.Contains(parent.Class, "MultiBranch") {
+			build.Job = pickString(parent.FullName, parent.Name)
+			build.Branch, _ = url.PathUnescape(job.Name)
+		}
+
+		switch b.Result {
+		case "SUCCESS":
+			build.Passed = true
+		case "FAILURE", "UNSTABLE":
+			build.Passed = false
+		default:
+			// Aborted and not built say nothing about the job's health
+			continue
+		}
+
+		builds = append(builds, build)
+	}
+
+	return builds
+}
+
+func (ci *CI) Run(conductor chan *choir.Note) {
+	if ci.Backend == "" {
+		return
+	}
+
+	// Without a checkpoint the first poll only learns where each job
+	// stands, rather than replaying the builds before it
+	primed := Checkpoints.Load(ci.checkpointKey(), &ci.States) && ci.States != nil
+	if ci.States == nil {
+		ci.States = make(map[string]CIState)
+	}
+
+	for {
+		builds, err := ci.FetchBuilds()
+
+		for _, build := range builds {
+			if !ci.Wanted(build) {
+				continue
+			}
+
+			if note := ci.Observe(build); note != nil && primed {
+				go func() {
+					conductor <- note
+				}()
+			}
+		}
+
+		if err == nil {
+			primed = true
+			Checkpoints.Save(ci.checkpointKey(), ci.States)
+		}
+
+		time.Sleep(ci.Health.Observe(err, ci.Interval, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered CI")
+	RegisterFactory("ci", func() Servicer { return &CI{} })
+}
@@ -0,0 +1,91 @@
+package ensemble
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const githubApiUrl = "https://api.github.com"
+
+// GitHub Actions workflow runs API
+type GithubRuns struct {
+	Workflow_Runs []GithubRun
+}
+
+type GithubRun struct {
+	Id             int64
+	Name           string
+	Run_Number     int64
+	Run_Attempt    int64
+	Head_Branch    string
+	Conclusion     string
+	Html_Url       string
+	Run_Started_At time.Time
+	Updated_At     time.Time
+}
+
+// Build turns a workflow run into a build of the workflow in repo.
+func (run *GithubRun) Build(repo string) (build CIBuild, ok bool) {
+	build = CIBuild{
+		Job:    fmt.Sprintf("%s %s", repo, run.Name),
+		Branch: run.Head_Branch,
+		Number: run.Run_Number,
+		Url:    run.Html_Url,
+
+		// Reruns keep the run's id, so count attempts too
+		Order: run.Id*100 + run.Run_Attempt,
+	}
+	if !run.Run_Started_At.IsZero() && run.Updated_At.After(run.Run_Started_At) {
+		build.Duration = run.Updated_At.Sub(run.Run_Started_At)
+	}
+
+	switch run.Conclusion {
+	case "success":
+		build.Passed = true
+	case "failure", "timed_out", "startup_failure":
+		build.Passed = false
+	default:
+		// Cancelled and skipped runs say nothing about the workflow's health
+		return build, false
+	}
+
+	return build, true
+}
+
+// FetchActions returns the recently finished workflow runs of every repo,
+// oldest first.
+func (ci *CI) FetchActions() (builds []CIBuild, err error) {
+	apiUrl := ci.Url
+	if apiUrl == "" {
+		apiUrl = githubApiUrl
+	}
+
+	for _, repo := range ci.Repos {
+		runsUrl := fmt.Sprintf("%s/repos/%s/actions/runs?status=completed&per_page=50", apiUrl, repo)
+		req, rerr := http.NewRequest("GET", runsUrl, nil)
+		if rerr != nil {
+			log.Printf("ERR building request: %s", rerr)
+			return builds, rerr
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if ci.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+ci.Token)
+		}
+
+		var runs GithubRuns
+		if err = FetchJSON(ci.Name, ci.Client, req, &runs); err != nil {
+			return
+		}
+
+		// Runs come newest first
+		for i := len(runs.Workflow_Runs) - 1; i >= 0; i-- {
+			if build, ok := runs.Workflow_Runs[i].Build(repo); ok {
+				builds = append(builds, build)
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,235 @@
+package ensemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const commandDefaultInterval = 60 * time.Second
+const commandDefaultTimeout = 30 * time.Second
+
+// How long to wait for output once a command that timed out has been
+// killed. Anything it started may still hold the pipes open.
+const commandWaitDelay = time.Second
+
+// Command runs a shell command on a schedule, like a health check, and
+// sings when its exit code or the value it reports changes.
+type Command struct {
+	Name     string
+	Command  string
+	Interval time.Duration
+	Timeout  time.Duration
+	Match    *regexp.Regexp
+	Sounds   CommandSounds
+	Choir    *choir.Choir
+
+	// What happened last time it ran
+	Checked      bool
+	LastExit     int
+	LastValue    string
+	LastOutput   string
+	LastDuration time.Duration
+}
+
+type CommandSounds struct {
+	Failure  string
+	Recovery string
+	Change   string
+}
+
+type CommandConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Name     string
+	Command  string
+	Interval int
+	Timeout  int
+	Match    string
+	Sounds   CommandSounds
+}
+
+// CommandResult is the outcome of one run of the command.
+type CommandResult struct {
+	Exit     int
+	Value    string
+	Output   string
+	Duration time.Duration
+}
+
+func (c *Command) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject CommandConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if strings.TrimSpace(configObject.Command) == "" {
+		log.Printf("ERR command source needs a command")
+		return
+	}
+
+	if configObject.Match != "" {
+		match, err := regexp.Compile(configObject.Match)
+		if err != nil {
+			log.Printf("ERR bad match for command %s: %s", configObject.Name, err)
+			return
+		}
+		c.Match = match
+	}
+
+	c.Command = configObject.Command
+	c.Name = configObject.Name
+	if c.Name == "" {
+		c.Name = strings.Fields(c.Command)[0]
+	}
+	c.Interval = time.Duration(configObject.Interval) * time.Second
+	if c.Interval <= 0 {
+		c.Interval = commandDefaultInterval
+	}
+	c.Timeout = time.Duration(configObject.Timeout) * time.Second
+	if c.Timeout <= 0 {
+		c.Timeout = commandDefaultTimeout
+	}
+
+	c.Sounds = configObject.Sounds
+	c.Sounds.Failure = pickString(c.Sounds.Failure, "b/2")
+	c.Sounds.Recovery = pickString(c.Sounds.Recovery, "g/2")
+	c.Sounds.Change = pickString(c.Sounds.Change, "n/1")
+
+	c.Choir = choir.NewChoir(configObject.Key)
+	c.Choir.Format = notetext.ParseFormat(configObject.Format)
+
+	fmt.Printf("Configured command: %s\n", c.Name)
+}
+
+// Check runs the command once. Running over the timeout counts as exit -1.
+func (c *Command) Check() CommandResult {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c.Command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = commandWaitDelay
+
+	started := time.Now()
+	err := cmd.Run()
+	result := CommandResult{
+		Output:   strings.TrimSpace(output.String()),
+		Duration: time.Since(started),
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case ctx.Err() == context.DeadlineExceeded:
+		result.Exit = -1
+		result.Output = fmt.Sprintf("timed out after %s", c.Timeout)
+	case errors.As(err, &exitErr):
+		result.Exit = exitErr.ExitCode()
+	default:
+		result.Exit = -1
+		result.Output = err.Error()
+	}
+
+	if c.Match != nil {
+		if found := c.Match.FindStringSubmatch(result.Output); found != nil {
+			result.Value = found[0]
+			if len(found) > 1 {
+				result.Value = found[1]
+			}
+		}
+	}
+
+	return result
+}
+
+// Compare works out whether a result is worth singing about, given the one
+// before it. The first check only sings if it's failing.
+func (c *Command) Compare(result CommandResult) *choir.Note {
+	wasChecked, lastExit, lastValue := c.Checked, c.LastExit, c.LastValue
+	wasFailing := lastExit != 0
+
+	c.Checked = true
+	c.LastExit = result.Exit
+	c.LastValue = result.Value
+	c.LastOutput = result.Output
+	c.LastDuration = result.Duration
+
+	failing := result.Exit != 0
+	var label, sound, text string
+
+	switch {
+	case failing && (!wasChecked || !wasFailing):
+		label, sound = "failed", c.Sounds.Failure
+		text = fmt.Sprintf("%s failed (exit %d) after %s", c.Name, result.Exit, roundDuration(result.Duration))
+	case failing && result.Exit != lastExit:
+		label, sound = "failed", c.Sounds.Failure
+		text = fmt.Sprintf("%s failed differently (exit %d, was %d) after %s", c.Name, result.Exit, lastExit, roundDuration(result.Duration))
+	case !failing && wasChecked && wasFailing:
+		label, sound = "recovered", c.Sounds.Recovery
+		text = fmt.Sprintf("%s recovered after %s", c.Name, roundDuration(result.Duration))
+	case c.Match != nil && wasChecked && result.Value != lastValue:
+		label, sound = "changed", c.Sounds.Change
+		text = fmt.Sprintf("%s changed from %s to %s", c.Name, lastValue, result.Value)
+	default:
+		return nil
+	}
+
+	if result.Output != "" {
+		lines := strings.Split(result.Output, "\n")
+		text = fmt.Sprintf("%s: %s", text, notetext.Truncate(lines[len(lines)-1], 200))
+	}
+
+	return &choir.Note{
+		Label: fmt.Sprintf("Check:%s", label),
+		Sound: sound,
+		Text:  notetext.Render(text, c.Choir.Format),
+		Choir: c.Choir,
+	}
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(100 * time.Millisecond)
+	}
+	return d.Round(time.Millisecond)
+}
+
+func (c *Command) Run(conductor chan *choir.Note) {
+	if c.Command == "" {
+		return
+	}
+
+	for {
+		result := c.Check()
+		log.Printf("%s exited %d in %s", c.Name, result.Exit, roundDuration(result.Duration))
+
+		if note := c.Compare(result); note != nil {
+			go func() {
+				conductor <- note
+			}()
+		}
+
+		time.Sleep(c.Interval)
+	}
+}
+
+func init() {
+	fmt.Println("Registered Command")
+	RegisterFactory("command", func() Servicer { return &Command{} })
+}
@@ -10,10 +10,17 @@ import (
 	"time"
 
 	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
 )
 
 const deskComUrl = "https://%s.desk.com/api/v2"
 
+// How many cases we'll look up history for at once, unless configured
+const deskDefaultWorkers = 4
+
+// How long user and group names are trusted before looking them up again
+const deskNameTTL = 1 * time.Hour
+
 type Desk struct {
 	Url      string
 	Username string
@@ -22,13 +29,32 @@ type Desk struct {
 
 	LastUpdate time.Time
 
-	Users map[int]string
+	Client  *http.Client
+	Workers int
+
+	Users   *NameCache
+	Groups  *NameCache
+	Health  SourceHealth
+	Verbs   map[string]DeskVerb
+	Filters DeskFilters
+}
+
+// DeskFilters limit which cases make a sound. Empty filters match every case.
+type DeskFilters struct {
+	Status       []string
+	Min_Priority int
+	Labels       []string
+	Groups       []string
 }
 
 type DeskConfig struct {
-	Type string
-	Key  string
-	Http struct {
+	Type    string
+	Key     string
+	Format  string
+	Verbs   map[string]DeskVerb
+	Filters DeskFilters
+	Workers int
+	Http    struct {
 		Orgname  string
 		Username string
 		Password string
@@ -45,6 +71,8 @@ type DeskFeed struct {
 type DeskEntry struct {
 	Subject    string
 	Status     string
+	Priority   int
+	Labels     []string
 	Created_At time.Time
 	Updated_At time.Time
 	Links      map[string]DeskLink `json:"_links"`
@@ -54,6 +82,10 @@ type DeskUser struct {
 	Name string
 }
 
+type DeskGroup struct {
+	Name string
+}
+
 type CaseHistory struct {
 	Total_Entries int
 	Embedded      struct {
@@ -74,6 +106,70 @@ func (de *DeskEntry) Id() string {
 	return parts[len(parts)-1]
 }
 
+// GroupId is the id of the group the case is assigned to, or 0 if none.
+func (de *DeskEntry) GroupId() (group_id int) {
+	if group, ok := de.Links["assigned_group"]; ok {
+		parts := strings.Split(group.Href, "/")
+		group_id, _ = strconv.Atoi(parts[len(parts)-1])
+	}
+
+	return
+}
+
+func (de *DeskEntry) GetGroupName(d *Desk) string {
+	group_id := de.GroupId()
+	if group_id == 0 {
+		return ""
+	}
+
+	name, _ := d.Groups.Get(strconv.Itoa(group_id), func() (string, error) {
+		group := new(DeskGroup)
+		err := d.GetUrl(fmt.Sprintf("/groups/%d", group_id), group)
+		return group.Name, err
+	})
+
+	return name
+}
+
+// Matches reports whether the case passes the configured filters.
+func (de *DeskEntry) Matches(d *Desk) bool {
+	f := d.Filters
+
+	if len(f.Status) > 0 && !containsFold(f.Status, de.Status) {
+		return false
+	}
+
+	if f.Min_Priority > 0 && de.Priority < f.Min_Priority {
+		return false
+	}
+
+	if len(f.Labels) > 0 {
+		found := false
+		for _, label := range de.Labels {
+			if containsFold(f.Labels, label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// Groups can be configured by id or by name
+	if len(f.Groups) > 0 {
+		group_id := de.GroupId()
+		if group_id == 0 {
+			return false
+		}
+		if !containsString(f.Groups, strconv.Itoa(group_id)) && !containsFold(f.Groups, de.GetGroupName(d)) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (de *DeskEntry) GetHistory(d *Desk) *CaseHistory {
 	historyPath := fmt.Sprintf("/cases/%s/history?per_page=100", de.Id())
 	full_history := new(CaseHistory)
@@ -81,8 +177,9 @@ func (de *DeskEntry) GetHistory(d *Desk) *CaseHistory {
 	for {
 		history := new(CaseHistory)
 
-		// TODO: OK response
-		d.GetUrl(historyPath, history)
+		if err := d.GetUrl(historyPath, history); err != nil {
+			break
+		}
 		full_history.Total_Entries += history.Total_Entries
 		full_history.Embedded.Entries = append(full_history.Embedded.Entries, history.Embedded.Entries...)
 
@@ -99,41 +196,210 @@ func (de *DeskEntry) GetHistory(d *Desk) *CaseHistory {
 	return full_history
 }
 
-// TODO:
-// Build a map of:
-// User -> unique actions
-// Actions to verbs
-// Figure out a way to:
-// Build a sentence from above map
-// If there is no user, do we just say "The case was reopened"?
-func (de *DeskEntry) BuildDescription(d *Desk, since_updated_at time.Time) string {
-	descriptions := make([]string, 0)
-	history_items := de.GetHistory(d)
+// DeskVerb is how a history type reads in a case summary. Active follows the
+// user who did it ("replied to"), Passive is used when nobody did
+// ("was reopened"). A verb with no Active phrase is left out of summaries.
+type DeskVerb struct {
+	Active  string
+	Passive string
+}
+
+// Default verbs for Desk history types, overridable with "verbs" in config.
+var deskVerbs = map[string]DeskVerb{
+	"case_created":     {"created", "was created"},
+	"case_updated":     {"updated", "was updated"},
+	"case_assigned":    {"assigned", "was assigned"},
+	"case_reassigned":  {"reassigned", "was reassigned"},
+	"case_resolved":    {"resolved", "was resolved"},
+	"case_closed":      {"closed", "was closed"},
+	"case_reopened":    {"reopened", "was reopened"},
+	"case_merged":      {"merged", "was merged"},
+	"reply_created":    {"replied to", "was replied to"},
+	"customer_reply":   {"replied to", "got a customer reply"},
+	"note_created":     {"added a note to", "got a note"},
+	"email_sent":       {"emailed about", "had an email sent"},
+	"labels_changed":   {"relabeled", "was relabeled"},
+	"priority_changed": {"reprioritized", "was reprioritized"},
+	"status_changed":   {"changed the status of", "changed status"},
+	"rule_applied":     {},
+}
+
+// Verb returns how the given history type reads in a summary.
+func (d *Desk) Verb(historyType string) DeskVerb {
+	verb, ok := d.Verbs[historyType]
+	if !ok {
+		verb, ok = deskVerbs[historyType]
+	}
+	if !ok {
+		verb = DeskVerb{Active: "updated"}
+	}
+	if verb.Active != "" && verb.Passive == "" {
+		verb.Passive = "was " + verb.Active
+	}
+	return verb
+}
+
+// RecentHistory returns the case's history items from since onwards.
+func (de *DeskEntry) RecentHistory(d *Desk, since_updated_at time.Time) []HistoryEntry {
+	recent := make([]HistoryEntry, 0)
+
+	for _, item := range de.GetHistory(d).Embedded.Entries {
+		if !item.Created_At.Before(since_updated_at) {
+			recent = append(recent, item)
+		}
+	}
+
+	return recent
+}
+
+// Transition works out the most notable thing that happened to the case in
+// the given history: "new", "reopened", "resolved", "reply" or "updated".
+func (de *DeskEntry) Transition(history []HistoryEntry) string {
+	types := make([]string, 0, len(history))
+	for _, item := range history {
+		types = append(types, item.Type)
+	}
+
+	switch {
+	case containsString(types, "case_reopened"):
+		return "reopened"
+	case containsString(types, "case_created"):
+		return "new"
+	case containsString(types, "case_resolved") || containsString(types, "case_closed"):
+		return "resolved"
+	case containsString(types, "customer_reply"):
+		return "reply"
+	case de.Status == "new" && len(types) == 0:
+		return "new"
+	}
+
+	return "updated"
+}
+
+// Sounds for each case transition. New and reopened cases are the ones
+// support needs to hear about.
+func DeskSoundClass(transition string) string {
+	switch transition {
+	case "new":
+		return "b/1"
+	case "reopened":
+		return "b/2"
+	case "resolved":
+		return "g/1"
+	case "reply":
+		return "n/1"
+	default:
+		return "n/0"
+	}
+}
+
+// BuildDescription summarizes the given history as a sentence, e.g. "Alice
+// replied to and resolved case 123", followed by the case subject. Actions
+// nobody performed read as "Case 123 was reopened".
+func (de *DeskEntry) BuildDescription(d *Desk, history []HistoryEntry) string {
+	// User -> unique verbs, both in the order they first happened
 	users := make([]string, 0)
+	user_verbs := make(map[string][]string)
 
-	for _, item := range history_items.Embedded.Entries {
-		if item.Created_At.Before(since_updated_at) || item.Type == "rule_applied" {
+	for _, item := range history {
+		verb := d.Verb(item.Type)
+		if verb.Active == "" {
 			continue
 		}
-		user := item.GetUserName(d)
-		description_string := fmt.Sprintf("%s by %s", item.Type, user)
-		descriptions = append(descriptions, description_string)
-		if len(user) > 0 {
-			users = append(users, user)
+
+		users = addAction(users, user_verbs, item.GetUserName(d), verb)
+	}
+
+	summary := de.Summarize(users, user_verbs)
+	subject := fmt.Sprintf("\"%s\"", notetext.Clean(de.Subject, 200))
+	return notetext.Join([]string{summary, subject}, d.Choir.Format)
+}
+
+// addAction records that user did verb, or that it happened if there's no
+// user, returning users with user added the first time they're seen.
+func addAction(users []string, user_verbs map[string][]string, user string, verb DeskVerb) []string {
+	phrase := verb.Active
+	if user == "" {
+		phrase = verb.Passive
+	}
+
+	if _, seen := user_verbs[user]; !seen {
+		users = append(users, user)
+	}
+	if !containsString(user_verbs[user], phrase) {
+		user_verbs[user] = append(user_verbs[user], phrase)
+	}
+
+	return users
+}
+
+// Summarize builds a single sentence out of who did what to the case.
+func (de *DeskEntry) Summarize(users []string, user_verbs map[string][]string) string {
+	return summarizeActions(fmt.Sprintf("case %s", de.Id()), users, user_verbs)
+}
+
+// summarizeActions builds a sentence like "Alice replied to and resolved
+// case 123" out of who did what. The thing is named in the first clause and
+// referred to as "it" afterwards. Actions nobody performed are under "".
+func summarizeActions(name string, users []string, user_verbs map[string][]string) string {
+	case_name := name
+	clauses := make([]string, 0, len(users))
+
+	for _, user := range users {
+		verbs := joinList(user_verbs[user])
+		if user == "" {
+			// Passive clauses go last so they don't steal the case name
+			continue
 		}
+		clauses = append(clauses, fmt.Sprintf("%s %s %s", user, verbs, case_name))
+		case_name = "it"
+	}
+
+	if verbs, ok := user_verbs[""]; ok {
+		subject := "it"
+		if case_name != "it" {
+			subject = strings.ToUpper(case_name[:1]) + case_name[1:]
+		}
+		clauses = append(clauses, fmt.Sprintf("%s %s", subject, joinList(verbs)))
+	}
+
+	if len(clauses) == 0 {
+		return fmt.Sprintf("%s was updated", strings.ToUpper(name[:1])+name[1:])
 	}
 
-	user_actions := strings.Join(descriptions, "<br />")
-	case_name := de.Subject
-	return fmt.Sprintf("Case %s: \"%s\"<br />%s", de.Id(), case_name, user_actions)
+	return joinList(clauses)
+}
+
+// joinList joins items as "a", "a and b" or "a, b and c".
+func joinList(items []string) string {
+	switch len(items) {
+	case 0:
+		return ""
+	case 1:
+		return items[0]
+	default:
+		return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+	}
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
 
-	// if len(users) == 0 {
-	// 	return fmt.Sprintf("Updated case %s: \"%s\"", de.Id(), case_name)
-	// } else {
-	// 	all_users := strings.Join(users, ", and ")
-	// 	return fmt.Sprintf("%s updated case %s: \"%s\"", all_users, de.Id(), case_name)
-	// }
+func containsFold(items []string, item string) bool {
+	for _, i := range items {
+		if strings.EqualFold(i, item) {
+			return true
+		}
+	}
+	return false
 }
+
 func (he *HistoryEntry) UserId() (user_id int) {
 	if invoker, ok := he.Links["invoker"]; ok {
 		parts := strings.Split(invoker.Href, "/")
@@ -144,19 +410,19 @@ func (he *HistoryEntry) UserId() (user_id int) {
 	return
 }
 
-func (he *HistoryEntry) GetUserName(d *Desk) (name string) {
-	if name, ok := d.Users[he.UserId()]; ok {
-		return name
+func (he *HistoryEntry) GetUserName(d *Desk) string {
+	user_id := he.UserId()
+	if user_id == 0 {
+		return ""
 	}
 
-	userPath := fmt.Sprintf("/users/%d", he.UserId())
-	user := new(DeskUser)
+	name, _ := d.Users.Get(strconv.Itoa(user_id), func() (string, error) {
+		user := new(DeskUser)
+		err := d.GetUrl(fmt.Sprintf("/users/%d", user_id), user)
+		return user.Name, err
+	})
 
-	// TODO: OK response
-	d.GetUrl(userPath, user)
-
-	d.Users[he.UserId()] = user.Name
-	return user.Name
+	return name
 }
 
 type DeskLink struct {
@@ -176,31 +442,69 @@ func (d *Desk) Configure(config interface{}) {
 	d.Url = fmt.Sprintf(deskComUrl, configObject.Http.Orgname)
 	d.Username = configObject.Http.Username
 	d.Password = configObject.Http.Password
-	d.Choir = &choir.Choir{configObject.Key}
+	d.Choir = choir.NewChoir(configObject.Key)
+	d.Choir.Format = notetext.ParseFormat(configObject.Format)
+	d.Health = SourceHealth{Name: "Desk", Choir: d.Choir}
+
+	d.Workers = configObject.Workers
+	if d.Workers <= 0 {
+		d.Workers = deskDefaultWorkers
+	}
+
+	// Limit connections to Desk to one per worker, however many cases change
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = d.Workers
+	d.Client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
 
-	d.Users = make(map[int]string)
+	d.Users = NewNameCache(deskNameTTL)
+	d.Groups = NewNameCache(deskNameTTL)
+	d.Verbs = configObject.Verbs
+	d.Filters = configObject.Filters
 
 	fmt.Printf("Configured Desk: %s\n", configObject.Http.Orgname)
 }
 
+// deskUpdate is a changed case waiting for a worker to summarize it.
+type deskUpdate struct {
+	entry DeskEntry
+	since time.Time
+}
+
 func (d *Desk) Run(conductor chan *choir.Note) {
+	// A burst of updated cases queues up for a fixed set of workers rather
+	// than each getting its own goroutine and connections.
+	updates := make(chan deskUpdate, 100)
+	for i := 0; i < d.Workers; i++ {
+		go d.work(updates, conductor)
+	}
+
 	for {
 		last_update := d.LastUpdate
-		feed := d.FetchUpdates()
+		feed, err := d.FetchUpdates()
 
 		for _, entry := range feed.Embedded.Entries {
-			go func(e DeskEntry) {
-				note := &choir.Note{
-					Label: "Customer",
-					Sound: "n/1",
-					Text:  e.BuildDescription(d, last_update),
-					Choir: d.Choir,
-				}
-				conductor <- note
-			}(entry)
+			updates <- deskUpdate{entry: entry, since: last_update}
 		}
 
-		time.Sleep(10 * time.Second)
+		time.Sleep(d.Health.Observe(err, 10*time.Second, conductor))
+	}
+}
+
+func (d *Desk) work(updates chan deskUpdate, conductor chan *choir.Note) {
+	for update := range updates {
+		e := update.entry
+		if !e.Matches(d) {
+			continue
+		}
+
+		history := e.RecentHistory(d, update.since)
+		transition := e.Transition(history)
+		conductor <- &choir.Note{
+			Label: fmt.Sprintf("Customer:%s", transition),
+			Sound: DeskSoundClass(transition),
+			Text:  e.BuildDescription(d, history),
+			Choir: d.Choir,
+		}
 	}
 }
 
@@ -212,10 +516,10 @@ func init() {
 // ####################################
 // API IMPLEMENTATION
 // ####################################
-func (d *Desk) FetchUpdates() (feed DeskFeed) {
+func (d *Desk) FetchUpdates() (feed DeskFeed, err error) {
 	feedUrl := fmt.Sprintf("/cases/search?since_updated_at=%d", d.LastUpdate.Unix())
 
-	err := d.GetUrl(feedUrl, &feed)
+	err = d.GetUrl(feedUrl, &feed)
 
 	if err == nil && len(feed.Embedded.Entries) > 0 {
 		d.LastUpdate = time.Now()
@@ -228,6 +532,11 @@ func (d *Desk) FetchUpdates() (feed DeskFeed) {
 func (d *Desk) GetUrl(path string, decode_object interface{}) error {
 	url := fmt.Sprintf("%s%s", d.Url, path)
 
+	// Links from the API, like history's "next", are already absolute paths
+	if strings.HasPrefix(path, "/api/") {
+		url = fmt.Sprintf("%s%s", strings.TrimSuffix(d.Url, "/api/v2"), path)
+	}
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Printf("ERR building request: %s", err)
@@ -236,19 +545,5 @@ func (d *Desk) GetUrl(path string, decode_object interface{}) error {
 
 	req.SetBasicAuth(d.Username, d.Password)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("ERR making request: %s", err)
-		return err
-	}
-	defer resp.Body.Close()
-
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&decode_object)
-	if err != nil {
-		log.Printf("ERR decoding json from Desk: %s\n%s", err, resp.Body)
-		return err
-	}
-
-	return nil
+	return FetchJSON("Desk", d.Client, req, decode_object)
 }
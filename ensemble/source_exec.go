@@ -0,0 +1,240 @@
+package ensemble
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// A plugin that stays up this long is healthy, even if it then exits
+const execHealthyRun = 1 * time.Minute
+
+// Longest line a plugin can write
+const execMaxLine = 1 << 20
+
+// Exec runs an external program and sings the notes it prints, one JSON
+// object per line, so sources can be written in any language.
+type Exec struct {
+	Name      string
+	Command   string
+	Args      []string
+	Env       []string
+	Dir       string
+	ConfigVia string
+	Config    []byte
+	Choir     *choir.Choir
+	Health    SourceHealth
+}
+
+type ExecConfig struct {
+	Type       string
+	Key        string
+	Format     string
+	Name       string
+	Command    string
+	Args       []string
+	Env        map[string]string
+	Dir        string
+	Config_Via string
+}
+
+// ExecNote is a line of plugin output. Key sends the note to a different
+// choir than the source's.
+type ExecNote struct {
+	Label string
+	Sound string
+	Text  string
+	Key   string
+}
+
+func (e *Exec) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject ExecConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Command == "" {
+		log.Printf("ERR exec source needs a command")
+		return
+	}
+
+	e.Command = configObject.Command
+	e.Args = configObject.Args
+	e.Dir = configObject.Dir
+	e.Name = configObject.Name
+	if e.Name == "" {
+		e.Name = filepath.Base(e.Command)
+	}
+	e.Choir = choir.NewChoir(configObject.Key)
+	e.Choir.Format = notetext.ParseFormat(configObject.Format)
+	e.Health = SourceHealth{Name: e.Name, Choir: e.Choir}
+
+	// The plugin gets its whole source config, so it can have settings of
+	// its own alongside ours
+	e.Config = jsonString
+	e.ConfigVia = configObject.Config_Via
+	if e.ConfigVia == "" {
+		e.ConfigVia = "stdin"
+	}
+
+	e.Env = os.Environ()
+	for name, value := range configObject.Env {
+		e.Env = append(e.Env, fmt.Sprintf("%s=%s", name, value))
+	}
+	if e.ConfigVia == "env" {
+		e.Env = append(e.Env, fmt.Sprintf("CHOIRMASTER_CONFIG=%s", e.Config))
+	}
+
+	fmt.Printf("Configured exec: %s\n", e.Name)
+}
+
+// Start launches the plugin and hands it its config. Its stderr is logged
+// until logged is done, which must happen before cmd.Wait.
+func (e *Exec) Start() (cmd *exec.Cmd, stdout io.Reader, logged *sync.WaitGroup, err error) {
+	cmd = exec.Command(e.Command, e.Args...)
+	cmd.Env = e.Env
+	cmd.Dir = e.Dir
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	logged = new(sync.WaitGroup)
+	logged.Add(1)
+	go func() {
+		defer logged.Done()
+		e.logStderr(stderr)
+	}()
+
+	// Closing stdin tells the plugin there's no more config coming
+	go func() {
+		if e.ConfigVia == "stdin" {
+			stdin.Write(append(e.Config, '\n'))
+		}
+		stdin.Close()
+	}()
+
+	return
+}
+
+func (e *Exec) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 0, 4096), execMaxLine)
+	for scanner.Scan() {
+		log.Printf("%s: %s", e.Name, scanner.Text())
+	}
+
+	// Keep draining a line too long to log, so the plugin doesn't block
+	io.Copy(io.Discard, stderr)
+}
+
+// BuildNote turns a line of plugin output into a note.
+func (e *Exec) BuildNote(line []byte) (*choir.Note, error) {
+	var out ExecNote
+	if err := json.Unmarshal(line, &out); err != nil {
+		return nil, err
+	}
+
+	c := e.Choir
+	if out.Key != "" {
+		c = choir.NewChoir(out.Key)
+		c.Format = e.Choir.Format
+	}
+	if out.Label == "" {
+		out.Label = e.Name
+	}
+	if out.Sound == "" {
+		out.Sound = "n/0"
+	}
+
+	return &choir.Note{
+		Label: out.Label,
+		Sound: out.Sound,
+		Text:  notetext.Render(notetext.Clean(out.Text, 1000), c.Format),
+		Choir: c,
+	}, nil
+}
+
+// RunOnce runs the plugin until it exits, singing everything it prints.
+func (e *Exec) RunOnce(conductor chan *choir.Note) error {
+	cmd, stdout, logged, err := e.Start()
+	if err != nil {
+		log.Printf("ERR starting %s: %s", e.Name, err)
+		return err
+	}
+	log.Printf("Started %s (pid %d)", e.Name, cmd.Process.Pid)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 4096), execMaxLine)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		note, err := e.BuildNote(scanner.Bytes())
+		if err != nil {
+			log.Printf("ERR %s printed something that isn't a note: %s: %s", e.Name, err, snippet(scanner.Bytes()))
+			continue
+		}
+		conductor <- note
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("ERR reading from %s: %s", e.Name, err)
+		cmd.Process.Kill()
+	}
+
+	// The last of stderr is usually why it died
+	logged.Wait()
+	err = cmd.Wait()
+	log.Printf("%s exited: %v", e.Name, err)
+	return err
+}
+
+func (e *Exec) Run(conductor chan *choir.Note) {
+	if e.Command == "" {
+		return
+	}
+
+	// Keep the plugin running, backing off if it keeps dying
+	for {
+		started := time.Now()
+		err := e.RunOnce(conductor)
+
+		if time.Since(started) > execHealthyRun {
+			err = nil
+		} else if err == nil {
+			err = fmt.Errorf("%s exited straight away", e.Name)
+		}
+
+		time.Sleep(e.Health.Observe(err, time.Second, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered Exec")
+	RegisterFactory("exec", func() Servicer { return &Exec{} })
+}
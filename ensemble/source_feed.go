@@ -0,0 +1,329 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const feedDefaultInterval = 60 * time.Second
+
+// What a feed entry sounds like unless configured otherwise
+var feedDefaultTemplate = NoteTemplate{
+	Label: "{{.Feed}}:{{default \"entry\" .Category}}",
+	Sound: "n/0",
+	Text:  "{{.Title}}",
+}
+
+// Feed polls any Atom 1.0, RSS 2.0 or RSS 1.0 (RDF) feed.
+type Feed struct {
+	Name       string
+	Url        string
+	Username   string
+	Password   string
+	Interval   time.Duration
+	Choir      *choir.Choir
+	Health     SourceHealth
+	Seen       *RecentSet
+	Primed     bool
+	Default    *NoteMaker
+	Categories map[string]*NoteMaker
+}
+
+type FeedConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Name     string
+	Url      string
+	Interval int
+	Params   map[string]string
+	Http     struct {
+		Username string
+		Password string
+	}
+	NoteTemplate
+	Categories map[string]NoteTemplate
+}
+
+// XMLFeed decodes all three feed formats. Atom has entries at the top,
+// RSS 2.0 puts items in its channel and RDF puts them next to it.
+type XMLFeed struct {
+	XMLName  xml.Name
+	Title    string      `xml:"title"`
+	Entries  []AtomEntry `xml:"entry"`
+	RDFItems []RSSItem   `xml:"item"`
+	Channel  struct {
+		Title string    `xml:"title"`
+		Items []RSSItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type AtomEntry struct {
+	Id        string `xml:"id"`
+	Title     string `xml:"title"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Author    string `xml:"author>name"`
+	Summary   string `xml:"summary"`
+	Content   string `xml:"content"`
+	Links     []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Categories []struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+}
+
+type RSSItem struct {
+	Guid        string   `xml:"guid"`
+	About       string   `xml:"about,attr"`
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	PubDate     string   `xml:"pubDate"`
+	Date        string   `xml:"date"`
+	Author      string   `xml:"author"`
+	Creator     string   `xml:"creator"`
+	Categories  []string `xml:"category"`
+	Subject     string   `xml:"subject"`
+}
+
+// FeedItem is an entry from any kind of feed. It's what label, sound and
+// text templates are run against.
+type FeedItem struct {
+	Feed       string
+	Id         string
+	Title      string
+	Link       string
+	Author     string
+	Summary    string
+	Published  string
+	Category   string
+	Categories []string
+}
+
+func (ae *AtomEntry) Item() FeedItem {
+	item := FeedItem{
+		Id:        ae.Id,
+		Title:     ae.Title,
+		Author:    ae.Author,
+		Summary:   ae.Summary,
+		Published: ae.Published,
+	}
+	if item.Summary == "" {
+		item.Summary = ae.Content
+	}
+	if item.Published == "" {
+		item.Published = ae.Updated
+	}
+	for _, link := range ae.Links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			item.Link = link.Href
+			break
+		}
+	}
+	for _, category := range ae.Categories {
+		item.Categories = append(item.Categories, category.Term)
+	}
+	return item
+}
+
+func (ri *RSSItem) Item() FeedItem {
+	item := FeedItem{
+		Id:         ri.Guid,
+		Title:      ri.Title,
+		Link:       ri.Link,
+		Author:     ri.Author,
+		Summary:    ri.Description,
+		Published:  ri.PubDate,
+		Categories: ri.Categories,
+	}
+	if item.Id == "" {
+		item.Id = ri.About
+	}
+	if item.Author == "" {
+		item.Author = ri.Creator
+	}
+	if item.Published == "" {
+		item.Published = ri.Date
+	}
+	if ri.Subject != "" {
+		item.Categories = append(item.Categories, ri.Subject)
+	}
+	return item
+}
+
+// Items returns every entry in the feed, whatever its format.
+func (xf *XMLFeed) Items() []FeedItem {
+	items := make([]FeedItem, 0)
+	for _, entry := range xf.Entries {
+		items = append(items, entry.Item())
+	}
+	for _, item := range append(xf.Channel.Items, xf.RDFItems...) {
+		items = append(items, item.Item())
+	}
+
+	for i := range items {
+		item := &items[i]
+		item.Title = notetext.Collapse(notetext.FromHTML(item.Title))
+		item.Summary = notetext.Collapse(notetext.FromHTML(item.Summary))
+		if len(item.Categories) > 0 {
+			item.Category = item.Categories[0]
+		}
+		// Entry ids are optional in RSS
+		if item.Id == "" {
+			item.Id = item.Link
+		}
+		if item.Id == "" {
+			item.Id = item.Title
+		}
+	}
+
+	return items
+}
+
+func (f *Feed) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject FeedConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	feedUrl, err := url.Parse(configObject.Url)
+	if err != nil || configObject.Url == "" {
+		log.Printf("ERR feed source needs a url: %q", configObject.Url)
+		return
+	}
+
+	// Tokens and the like that the feed wants in its query string
+	query := feedUrl.Query()
+	for name, value := range configObject.Params {
+		query.Set(name, value)
+	}
+	feedUrl.RawQuery = query.Encode()
+
+	f.Url = feedUrl.String()
+	f.Name = configObject.Name
+	if f.Name == "" {
+		f.Name = feedUrl.Host
+	}
+	f.Username = configObject.Http.Username
+	f.Password = configObject.Http.Password
+	f.Interval = time.Duration(configObject.Interval) * time.Second
+	if f.Interval <= 0 {
+		f.Interval = feedDefaultInterval
+	}
+	f.Choir = choir.NewChoir(configObject.Key)
+	f.Choir.Format = notetext.ParseFormat(configObject.Format)
+	f.Health = SourceHealth{Name: f.Name, Choir: f.Choir}
+	f.Seen = NewRecentSet(1000)
+
+	if f.Default, err = configObject.NoteTemplate.Compile(feedDefaultTemplate); err != nil {
+		log.Printf("ERR configuring feed %s: %s", f.Name, err)
+		return
+	}
+
+	f.Categories = make(map[string]*NoteMaker)
+	for category, nt := range configObject.Categories {
+		// Anything not set for the category comes from the feed's templates
+		defaults := configObject.NoteTemplate.Over(feedDefaultTemplate)
+		if f.Categories[strings.ToLower(category)], err = nt.Compile(defaults); err != nil {
+			log.Printf("ERR configuring feed %s category %s: %s", f.Name, category, err)
+			return
+		}
+	}
+
+	fmt.Printf("Configured feed: %s\n", f.Name)
+}
+
+func (f *Feed) FetchUpdates() (items []FeedItem, err error) {
+	req, err := http.NewRequest("GET", f.Url, nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return
+	}
+
+	if f.Username != "" {
+		req.SetBasicAuth(f.Username, f.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("ERR making request for %s: %s", f.Name, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var feed XMLFeed
+	if err = DecodeXML(f.Name, resp, &feed); err != nil {
+		return
+	}
+
+	items = feed.Items()
+	for i := range items {
+		items[i].Feed = f.Name
+	}
+
+	return
+}
+
+// NoteMaker picks the templates for the item's first configured category.
+func (f *Feed) NoteMaker(item FeedItem) *NoteMaker {
+	for _, category := range item.Categories {
+		if nm, ok := f.Categories[strings.ToLower(category)]; ok {
+			return nm
+		}
+	}
+	return f.Default
+}
+
+func (f *Feed) Run(conductor chan *choir.Note) {
+	if f.Default == nil {
+		return
+	}
+
+	for {
+		items, err := f.FetchUpdates()
+
+		// Feeds list newest first, sing them in the order they happened
+		for i := len(items) - 1; i >= 0; i-- {
+			item := items[i]
+			if !f.Seen.Add(item.Id) || !f.Primed {
+				continue
+			}
+
+			note, nerr := f.NoteMaker(item).Make(f.Choir, item)
+			if nerr != nil {
+				log.Printf("ERR making note for %s: %s", f.Name, nerr)
+				continue
+			}
+
+			go func() {
+				conductor <- note
+			}()
+		}
+
+		// Whatever is in the feed when we start has already happened
+		if err == nil {
+			f.Primed = true
+		}
+
+		time.Sleep(f.Health.Observe(err, f.Interval, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered Feed")
+	RegisterFactory("feed", func() Servicer { return &Feed{} })
+}
@@ -16,11 +16,20 @@ type Github struct {
 	Url        string
 	LastUpdate time.Time
 	Choir      *choir.Choir
+	Health     SourceHealth
+
+	// Events API mode, see source_github_events.go
+	Mode         string
+	Token        string
+	ETag         string
+	PollInterval time.Duration
+	LastEventId  int64
 }
 
 type GithubConfig struct {
 	Type string
 	Key  string
+	Mode string
 	Http struct {
 		Username     string
 		Orgname      string
@@ -43,13 +52,27 @@ type GithubEntry struct {
 	Content    string    `xml:"content"`
 }
 
-func (je *GithubEntry) GetCategory() string {
+// GetType returns the event type from the entry's tag id, e.g. "PushEvent"
+func (je *GithubEntry) GetType() string {
 	firstSplit := strings.Split(je.Id, ":")
 	tagDirty := firstSplit[len(firstSplit)-1]
 
-	tag := strings.Split(tagDirty, "/")[0]
+	return strings.Split(tagDirty, "/")[0]
+}
+
+func (je *GithubEntry) GetCategory() string {
+	return fmt.Sprintf("GitHub:%s", je.GetType())
+}
 
-	return fmt.Sprintf("GitHub:%s", tag)
+// GetAction guesses the event's action from its title, which the feed
+// writes as "dacort merged pull request org/repo#1"
+func (je *GithubEntry) GetAction() string {
+	for _, action := range []string{"merged", "closed", "reopened", "opened"} {
+		if strings.Contains(je.Title, " "+action+" ") {
+			return action
+		}
+	}
+	return ""
 }
 
 func (g *Github) Configure(config interface{}) {
@@ -60,53 +83,93 @@ func (g *Github) Configure(config interface{}) {
 		return
 	}
 
-	// We could use the API, but the feed gives us pretty titles
-	// https://github.com/organizations/%s/%s.private.atom?token=%s
-	// https://api.github.com/users/%s/events/orgs/%s?access_token=%s
+	g.Choir = choir.NewChoir(configObject.Key)
+	g.Health = SourceHealth{Name: "GitHub", Choir: g.Choir}
+	g.Mode = configObject.Mode
+
+	// The API tells us more about each event but the feed has pretty titles
+	if g.Mode == "api" {
+		g.Url = fmt.Sprintf(githubEventsUrl, configObject.Http.Username, configObject.Http.Orgname)
+		g.Token = configObject.Http.Access_Token
+		fmt.Printf("Configured Github events API: %s\n", configObject.Http.Orgname)
+		return
+	}
+
 	g.Url = fmt.Sprintf("https://github.com/organizations/%s/%s.private.atom?token=%s",
 		configObject.Http.Orgname,
 		configObject.Http.Username,
 		configObject.Http.Access_Token,
 	)
-	g.Choir = &choir.Choir{configObject.Key}
 
 	fmt.Printf("Configured Github: %s\n", configObject.Http.Orgname)
 }
 
-func (g *Github) FetchUpdates() (feed GithubFeed) {
+func (g *Github) FetchUpdates() (feed GithubFeed, err error) {
 	resp, err := http.Get(g.Url)
 	if err != nil {
-		log.Printf("ERR making request for %s: %s", g.Url, err)
+		log.Printf("ERR making request for GitHub feed: %s", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	dec := xml.NewDecoder(resp.Body)
-	err = dec.Decode(&feed)
-	if err != nil {
-		log.Printf("ERR decoding xml from GitHub: %s\n%s", err, resp.Body)
-		return
-	}
-
+	err = DecodeXML("GitHub", resp, &feed)
 	return
 }
 
 func (ge *GithubEntry) SoundClass() string {
-	switch ge.GetCategory() {
+	return GithubSoundClass(ge.GetType(), ge.GetAction())
+}
+
+// GithubSoundClass picks a sound from an event type and, where there is
+// one, what was done: a merged pull request sounds different from a new one.
+func GithubSoundClass(eventType string, action string) string {
+	switch eventType {
 	case "PublicEvent":
 		return "g/3"
 	case "TeamAddEvent":
 		return "g/3"
+	case "ReleaseEvent":
+		return "g/3"
 	case "PullRequestEvent":
-		return "n/2"
+		switch action {
+		case "merged":
+			return "g/2"
+		case "closed":
+			return "n/1"
+		default:
+			return "n/2"
+		}
+	case "WorkflowRunEvent":
+		switch action {
+		case "success":
+			return "g/1"
+		case "failure", "timed_out":
+			return "b/2"
+		default:
+			return "n/0"
+		}
+	case "PullRequestReviewEvent":
+		switch action {
+		case "approved":
+			return "g/1"
+		case "changes_requested":
+			return "b/1"
+		default:
+			return "n/1"
+		}
 	default:
 		return "n/0"
 	}
 }
 
 func (g *Github) Run(conductor chan *choir.Note) {
+	if g.Mode == "api" {
+		g.RunEvents(conductor)
+		return
+	}
+
 	for {
-		feed := g.FetchUpdates()
+		feed, err := g.FetchUpdates()
 
 		for _, entry := range feed.Entry {
 			if entry.Published.Before(g.LastUpdate) {
@@ -129,7 +192,7 @@ func (g *Github) Run(conductor chan *choir.Note) {
 
 		}
 
-		time.Sleep(5 * time.Second)
+		time.Sleep(g.Health.Observe(err, 5*time.Second, conductor))
 	}
 }
 
@@ -0,0 +1,217 @@
+package ensemble
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const githubEventsUrl = "https://api.github.com/users/%s/events/orgs/%s"
+
+// GitHub asks for at least this long between polls of the events API, and
+// may ask for longer with X-Poll-Interval
+const githubDefaultPollInterval = 60 * time.Second
+
+// REST Events API
+type GithubEvent struct {
+	Id    string
+	Type  string
+	Actor struct {
+		Login string
+	}
+	Repo struct {
+		Name string
+	}
+	Created_At time.Time
+	Payload    GithubPayload
+}
+
+// GithubPayload holds the fields we use from all the event types we know.
+type GithubPayload struct {
+	Action        string
+	Ref           string
+	Ref_Type      string
+	Size          int
+	Distinct_Size int
+	Commits       []struct {
+		Sha     string
+		Message string
+	}
+	Pull_Request struct {
+		Number   int
+		Title    string
+		Merged   bool
+		Html_Url string
+	}
+	Issue struct {
+		Number   int
+		Title    string
+		Html_Url string
+	}
+	Comment struct {
+		Body     string
+		Html_Url string
+	}
+	Release struct {
+		Tag_Name string
+		Name     string
+		Html_Url string
+	}
+	Review struct {
+		State    string
+		Html_Url string
+	}
+	Workflow_Run struct {
+		Name        string
+		Head_Branch string
+		Status      string
+		Conclusion  string
+		Html_Url    string
+	}
+}
+
+func (ge *GithubEvent) GetCategory() string {
+	return fmt.Sprintf("GitHub:%s", ge.Type)
+}
+
+// GetAction returns what was done in the event. A closed pull request that
+// was merged is "merged" and reviews use their state, e.g. "approved".
+func (ge *GithubEvent) GetAction() string {
+	switch ge.Type {
+	case "PullRequestEvent":
+		if ge.Payload.Action == "closed" && ge.Payload.Pull_Request.Merged {
+			return "merged"
+		}
+	case "PullRequestReviewEvent":
+		if ge.Payload.Review.State != "" {
+			return strings.ToLower(ge.Payload.Review.State)
+		}
+	case "WorkflowRunEvent":
+		if ge.Payload.Workflow_Run.Conclusion != "" {
+			return ge.Payload.Workflow_Run.Conclusion
+		}
+	}
+	return ge.Payload.Action
+}
+
+func (ge *GithubEvent) SoundClass() string {
+	return GithubSoundClass(ge.Type, ge.GetAction())
+}
+
+// GetTitle describes the event the way the Atom feed would.
+func (ge *GithubEvent) GetTitle() string {
+	p := ge.Payload
+	actor := ge.Actor.Login
+	repo := ge.Repo.Name
+
+	switch ge.Type {
+	case "PushEvent":
+		commits := p.Size
+		if commits == 0 {
+			commits = len(p.Commits)
+		}
+		noun := "commits"
+		if commits == 1 {
+			noun = "commit"
+		}
+		return fmt.Sprintf("%s pushed %d %s to %s at %s", actor, commits, noun, strings.TrimPrefix(p.Ref, "refs/heads/"), repo)
+	case "PullRequestEvent":
+		return fmt.Sprintf("%s %s pull request %s#%d: %s", actor, ge.GetAction(), repo, p.Pull_Request.Number, p.Pull_Request.Title)
+	case "PullRequestReviewEvent":
+		state := strings.Replace(ge.GetAction(), "_", " ", -1)
+		return fmt.Sprintf("%s reviewed pull request %s#%d (%s): %s", actor, repo, p.Pull_Request.Number, state, p.Pull_Request.Title)
+	case "IssueCommentEvent":
+		return fmt.Sprintf("%s commented on %s#%d: %s", actor, repo, p.Issue.Number, notetext.Clean(p.Comment.Body, 140))
+	case "IssuesEvent":
+		return fmt.Sprintf("%s %s issue %s#%d: %s", actor, p.Action, repo, p.Issue.Number, p.Issue.Title)
+	case "ReleaseEvent":
+		name := p.Release.Name
+		if name == "" {
+			name = p.Release.Tag_Name
+		}
+		return fmt.Sprintf("%s %s release %s of %s", actor, p.Action, name, repo)
+	case "WorkflowRunEvent":
+		run := p.Workflow_Run
+		return fmt.Sprintf("%s %s on %s at %s", run.Name, strings.Replace(ge.GetAction(), "_", " ", -1), run.Head_Branch, repo)
+	case "CreateEvent", "DeleteEvent":
+		verb := strings.ToLower(strings.TrimSuffix(ge.Type, "Event")) + "d"
+		return fmt.Sprintf("%s %s %s %s at %s", actor, verb, p.Ref_Type, p.Ref, repo)
+	default:
+		return fmt.Sprintf("%s: %s at %s", strings.TrimSuffix(ge.Type, "Event"), actor, repo)
+	}
+}
+
+// FetchEvents asks for events newer than the last ETag we saw. An empty list
+// with no error means nothing has changed.
+func (g *Github) FetchEvents() (events []GithubEvent, err error) {
+	req, err := http.NewRequest("GET", g.Url, nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+g.Token)
+	if g.ETag != "" {
+		req.Header.Set("If-None-Match", g.ETag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("ERR making request for GitHub events: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("X-Poll-Interval")); err == nil && seconds > 0 {
+		g.PollInterval = time.Duration(seconds) * time.Second
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return
+	}
+
+	if err = DecodeJSON("GitHub", resp, &events); err != nil {
+		return
+	}
+
+	g.ETag = resp.Header.Get("ETag")
+	return
+}
+
+func (g *Github) RunEvents(conductor chan *choir.Note) {
+	g.PollInterval = githubDefaultPollInterval
+
+	for {
+		events, err := g.FetchEvents()
+
+		// Events come newest first
+		for i := len(events) - 1; i >= 0; i-- {
+			event := events[i]
+			id, _ := strconv.ParseInt(event.Id, 10, 64)
+			if id <= g.LastEventId || event.Created_At.Before(g.LastUpdate) {
+				continue
+			}
+			g.LastEventId = id
+
+			note := &choir.Note{
+				Label: event.GetCategory(),
+				Sound: event.SoundClass(),
+				Text:  notetext.Render(event.GetTitle(), g.Choir.Format),
+				Choir: g.Choir,
+			}
+
+			go func() {
+				conductor <- note
+			}()
+		}
+
+		time.Sleep(g.Health.Observe(err, g.PollInterval, conductor))
+	}
+}
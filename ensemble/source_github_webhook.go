@@ -0,0 +1,152 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// Webhook event names and the events API types they sound like
+var githubWebhookEvents = map[string]string{
+	"push":                "PushEvent",
+	"pull_request":        "PullRequestEvent",
+	"pull_request_review": "PullRequestReviewEvent",
+	"issues":              "IssuesEvent",
+	"issue_comment":       "IssueCommentEvent",
+	"release":             "ReleaseEvent",
+	"workflow_run":        "WorkflowRunEvent",
+	"create":              "CreateEvent",
+	"delete":              "DeleteEvent",
+	"public":              "PublicEvent",
+}
+
+type GithubWebhook struct {
+	Path       string
+	Secret     string
+	Choir      *choir.Choir
+	Notes      chan *choir.Note
+	Deliveries *RecentSet
+}
+
+type GithubWebhookConfig struct {
+	Type   string
+	Key    string
+	Path   string
+	Secret string
+}
+
+// A webhook delivery is an events API payload with the repository and
+// sender alongside it.
+type GithubWebhookPayload struct {
+	GithubPayload
+	Repository struct {
+		Full_Name string
+	}
+	Sender struct {
+		Login string
+	}
+}
+
+// Event turns a delivery into the events API shape so it's described and
+// voiced exactly like a polled event.
+func (p *GithubWebhookPayload) Event(eventType string) *GithubEvent {
+	event := &GithubEvent{Type: eventType, Payload: p.GithubPayload}
+	event.Actor.Login = p.Sender.Login
+	event.Repo.Name = p.Repository.Full_Name
+	return event
+}
+
+func (gw *GithubWebhook) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject GithubWebhookConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	gw.Path = configObject.Path
+	if gw.Path == "" {
+		gw.Path = "/github"
+	}
+	gw.Secret = configObject.Secret
+	gw.Choir = choir.NewChoir(configObject.Key)
+	gw.Notes = make(chan *choir.Note, 100)
+	gw.Deliveries = NewRecentSet(1000)
+
+	if gw.Secret == "" {
+		log.Printf("ERR github_webhook has no secret, deliveries can't be verified")
+	}
+
+	HandleInbound("GitHub webhook", gw.Path, gw)
+
+	fmt.Printf("Configured GitHub webhook: %s\n", gw.Path)
+}
+
+func (gw *GithubWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := ReadInbound(w, r)
+	if !ok {
+		return
+	}
+
+	if !ValidHMAC(gw.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		log.Printf("ERR GitHub webhook signature mismatch from %s", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	// GitHub redelivers on timeouts, and people redeliver by hand
+	delivery := r.Header.Get("X-GitHub-Delivery")
+	if delivery != "" && !gw.Deliveries.Add(delivery) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	eventType, known := githubWebhookEvents[r.Header.Get("X-GitHub-Event")]
+	if !known {
+		// Includes the ping GitHub sends when the hook is created
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var payload GithubWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("ERR decoding GitHub webhook: %s", err)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	if note := gw.BuildNote(payload.Event(eventType)); note != nil {
+		gw.Notes <- note
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// BuildNote returns nil for the in-between states we don't want to hear,
+// like workflow runs that have only just started.
+func (gw *GithubWebhook) BuildNote(event *GithubEvent) *choir.Note {
+	if event.Type == "WorkflowRunEvent" && event.Payload.Action != "completed" {
+		return nil
+	}
+
+	return &choir.Note{
+		Label: event.GetCategory(),
+		Sound: event.SoundClass(),
+		Text:  notetext.Render(event.GetTitle(), gw.Choir.Format),
+		Choir: gw.Choir,
+	}
+}
+
+func (gw *GithubWebhook) Run(conductor chan *choir.Note) {
+	for note := range gw.Notes {
+		conductor <- note
+	}
+}
+
+func init() {
+	fmt.Println("Registered GitHub webhook")
+	RegisterFactory("github_webhook", func() Servicer { return &GithubWebhook{} })
+}
@@ -0,0 +1,478 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const gitlabDefaultUrl = "https://gitlab.com"
+const gitlabDefaultInterval = 60 * time.Second
+
+// How often a group's list of projects is refreshed
+const gitlabProjectsRefresh = 1 * time.Hour
+
+// Gitlab polls the events API of a project, or of every project in a group,
+// on gitlab.com or a self-hosted GitLab.
+type Gitlab struct {
+	Url       string
+	Token     string
+	Project   string
+	Group     string
+	Pipelines bool
+	Interval  time.Duration
+	Client    *http.Client
+	Choir     *choir.Choir
+	Health    SourceHealth
+
+	// Project paths by id, and where we got to in each
+	Projects       map[int]string
+	ProjectsLoaded time.Time
+	LastEventId    map[int]int64
+	PipelinesSince map[int]time.Time
+	SeenPipelines  *RecentSet
+}
+
+type GitlabConfig struct {
+	Type      string
+	Key       string
+	Format    string
+	Url       string
+	Token     string
+	Project   string
+	Group     string
+	Pipelines bool
+	Interval  int
+}
+
+// GitlabEvent is a push, merge request, issue, comment or pipeline, from
+// either the events API or a webhook, so both sound the same.
+type GitlabEvent struct {
+	Type     string
+	Action   string
+	Actor    string
+	Project  string
+	Ref      string
+	Commits  int
+	Iid      int
+	Title    string
+	Body     string
+	Noteable string
+}
+
+// Events API
+type GitlabApiEvent struct {
+	Id              int64
+	Project_Id      int
+	Action_Name     string
+	Target_Type     string
+	Target_Iid      int
+	Target_Title    string
+	Author_Username string
+	Created_At      time.Time
+	Push_Data       struct {
+		Commit_Count int
+		Action       string
+		Ref_Type     string
+		Ref          string
+	}
+	Note struct {
+		Body          string
+		Noteable_Type string
+		Noteable_Iid  int
+	}
+}
+
+type GitlabProject struct {
+	Id                  int
+	Path_With_Namespace string
+}
+
+type GitlabPipeline struct {
+	Id         int
+	Status     string
+	Ref        string
+	Updated_At time.Time
+}
+
+func (gl *Gitlab) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject GitlabConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Project == "" && configObject.Group == "" {
+		log.Printf("ERR gitlab source needs a project or a group")
+		return
+	}
+
+	gl.Url = strings.TrimSuffix(configObject.Url, "/")
+	if gl.Url == "" {
+		gl.Url = gitlabDefaultUrl
+	}
+	gl.Token = configObject.Token
+	gl.Project = configObject.Project
+	gl.Group = configObject.Group
+	gl.Pipelines = configObject.Pipelines
+	gl.Interval = time.Duration(configObject.Interval) * time.Second
+	if gl.Interval <= 0 {
+		gl.Interval = gitlabDefaultInterval
+	}
+	gl.Client = &http.Client{Timeout: 30 * time.Second}
+
+	gl.Choir = choir.NewChoir(configObject.Key)
+	gl.Choir.Format = notetext.ParseFormat(configObject.Format)
+	gl.Health = SourceHealth{Name: "GitLab", Choir: gl.Choir}
+
+	gl.LastEventId = make(map[int]int64)
+	gl.PipelinesSince = make(map[int]time.Time)
+	gl.SeenPipelines = NewRecentSet(1000)
+
+	fmt.Printf("Configured GitLab: %s\n", pickString(gl.Project, gl.Group))
+}
+
+func (ge *GitlabEvent) GetCategory() string {
+	return fmt.Sprintf("GitLab:%s", ge.Type)
+}
+
+func (ge *GitlabEvent) SoundClass() string {
+	return GitlabSoundClass(ge.Type, ge.Action)
+}
+
+// GitlabSoundClass picks a sound the way GithubSoundClass does, so the same
+// things sound alike wherever the repo lives.
+func GitlabSoundClass(eventType string, action string) string {
+	switch eventType {
+	case "TagPushEvent":
+		if action == "created" {
+			return "g/3"
+		}
+		return "n/0"
+	case "MergeRequestEvent":
+		switch action {
+		case "merged":
+			return "g/2"
+		case "approved":
+			return "g/1"
+		case "closed":
+			return "n/1"
+		default:
+			return "n/2"
+		}
+	case "PipelineEvent":
+		switch action {
+		case "success":
+			return "g/1"
+		case "failed":
+			return "b/2"
+		default:
+			return "n/0"
+		}
+	case "IssueEvent":
+		switch action {
+		case "closed":
+			return "g/1"
+		case "reopened":
+			return "b/1"
+		default:
+			return "n/1"
+		}
+	default:
+		return "n/0"
+	}
+}
+
+// Worth returns false for the in-between states we don't want to hear, like
+// every push to an open merge request or a pipeline that's still running.
+func (ge *GitlabEvent) Worth() bool {
+	switch ge.Type {
+	case "MergeRequestEvent":
+		return containsString([]string{"opened", "closed", "reopened", "merged", "approved"}, ge.Action)
+	case "IssueEvent":
+		return containsString([]string{"opened", "closed", "reopened"}, ge.Action)
+	case "PipelineEvent":
+		return containsString([]string{"success", "failed", "canceled"}, ge.Action)
+	case "":
+		return false
+	default:
+		return true
+	}
+}
+
+// GetTitle describes the event in the same words as the GitHub sources.
+func (ge *GitlabEvent) GetTitle() string {
+	switch ge.Type {
+	case "PushEvent":
+		if ge.Action != "pushed" {
+			return fmt.Sprintf("%s %s branch %s at %s", ge.Actor, ge.Action, ge.Ref, ge.Project)
+		}
+		noun := "commits"
+		if ge.Commits == 1 {
+			noun = "commit"
+		}
+		return fmt.Sprintf("%s pushed %d %s to %s at %s", ge.Actor, ge.Commits, noun, ge.Ref, ge.Project)
+	case "TagPushEvent":
+		return fmt.Sprintf("%s %s tag %s at %s", ge.Actor, ge.Action, ge.Ref, ge.Project)
+	case "MergeRequestEvent":
+		return fmt.Sprintf("%s %s merge request %s!%d: %s", ge.Actor, ge.Action, ge.Project, ge.Iid, ge.Title)
+	case "IssueEvent":
+		return fmt.Sprintf("%s %s issue %s#%d: %s", ge.Actor, ge.Action, ge.Project, ge.Iid, ge.Title)
+	case "NoteEvent":
+		var on string
+		switch ge.Noteable {
+		case "MergeRequest":
+			on = fmt.Sprintf("%s!%d", ge.Project, ge.Iid)
+		case "Issue":
+			on = fmt.Sprintf("%s#%d", ge.Project, ge.Iid)
+		default:
+			on = fmt.Sprintf("a %s at %s", strings.ToLower(pickString(ge.Noteable, "commit")), ge.Project)
+		}
+		return fmt.Sprintf("%s commented on %s: %s", ge.Actor, on, notetext.Clean(ge.Body, 140))
+	case "PipelineEvent":
+		status := ge.Action
+		if status == "success" {
+			status = "passed"
+		}
+		return fmt.Sprintf("Pipeline #%d %s on %s at %s", ge.Iid, status, ge.Ref, ge.Project)
+	default:
+		return fmt.Sprintf("%s: %s at %s", strings.TrimSuffix(ge.Type, "Event"), ge.Actor, ge.Project)
+	}
+}
+
+// Event turns an events API entry into a GitlabEvent.
+func (ae *GitlabApiEvent) Event(project string) *GitlabEvent {
+	event := &GitlabEvent{
+		Actor:   ae.Author_Username,
+		Project: project,
+		Action:  ae.Action_Name,
+		Iid:     ae.Target_Iid,
+		Title:   ae.Target_Title,
+	}
+
+	switch {
+	case ae.Push_Data.Ref != "":
+		event.Type = "PushEvent"
+		if ae.Push_Data.Ref_Type == "tag" {
+			event.Type = "TagPushEvent"
+		}
+		event.Ref = ae.Push_Data.Ref
+		event.Commits = ae.Push_Data.Commit_Count
+		switch ae.Push_Data.Action {
+		case "created":
+			event.Action = "created"
+		case "removed":
+			event.Action = "deleted"
+		default:
+			event.Action = "pushed"
+		}
+		if event.Type == "TagPushEvent" && event.Action == "pushed" {
+			event.Action = "created"
+		}
+	case ae.Target_Type == "MergeRequest":
+		event.Type = "MergeRequestEvent"
+		if event.Action == "accepted" {
+			event.Action = "merged"
+		}
+	case ae.Target_Type == "Issue":
+		event.Type = "IssueEvent"
+	case strings.HasSuffix(ae.Target_Type, "Note"):
+		event.Type = "NoteEvent"
+		event.Noteable = ae.Note.Noteable_Type
+		event.Iid = ae.Note.Noteable_Iid
+		event.Body = ae.Note.Body
+	}
+
+	return event
+}
+
+// Get fetches path from the GitLab API into v.
+func (gl *Gitlab) Get(path string, query url.Values, v interface{}) error {
+	requestUrl := fmt.Sprintf("%s/api/v4/%s?%s", gl.Url, path, query.Encode())
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", gl.Token)
+
+	return FetchJSON("GitLab", gl.Client, req, v)
+}
+
+// LoadProjects finds the projects to poll: the configured one, or every
+// project in the group including subgroups.
+func (gl *Gitlab) LoadProjects() error {
+	projects := make([]GitlabProject, 0)
+
+	if gl.Project != "" {
+		var project GitlabProject
+		if err := gl.Get("projects/"+url.PathEscape(gl.Project), url.Values{}, &project); err != nil {
+			return err
+		}
+		projects = append(projects, project)
+	} else {
+		for page := 1; ; page++ {
+			query := url.Values{
+				"include_subgroups": {"true"},
+				"archived":          {"false"},
+				"per_page":          {"100"},
+				"page":              {strconv.Itoa(page)},
+			}
+			var batch []GitlabProject
+			if err := gl.Get("groups/"+url.PathEscape(gl.Group)+"/projects", query, &batch); err != nil {
+				return err
+			}
+			projects = append(projects, batch...)
+			if len(batch) < 100 {
+				break
+			}
+		}
+	}
+
+	gl.Projects = make(map[int]string)
+	for _, project := range projects {
+		gl.Projects[project.Id] = project.Path_With_Namespace
+	}
+	gl.ProjectsLoaded = time.Now()
+	return nil
+}
+
+// FetchEvents returns a project's events since the last poll, oldest first.
+// The first poll of a project only notes where it's up to.
+func (gl *Gitlab) FetchEvents(id int) (events []GitlabApiEvent, err error) {
+	query := url.Values{"per_page": {"100"}}
+	if err = gl.Get(fmt.Sprintf("projects/%d/events", id), query, &events); err != nil {
+		return nil, err
+	}
+
+	last, primed := gl.LastEventId[id]
+	fresh := make([]GitlabApiEvent, 0)
+
+	// Events come newest first
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Id <= last {
+			continue
+		}
+		last = events[i].Id
+		if primed {
+			fresh = append(fresh, events[i])
+		}
+	}
+
+	gl.LastEventId[id] = last
+	return fresh, nil
+}
+
+// FetchPipelines returns a project's pipelines that have finished since
+// the last poll.
+func (gl *Gitlab) FetchPipelines(id int) (pipelines []GitlabPipeline, err error) {
+	since, primed := gl.PipelinesSince[id]
+	if !primed {
+		gl.PipelinesSince[id] = time.Now()
+		return nil, nil
+	}
+
+	query := url.Values{
+		"updated_after": {since.Format(time.RFC3339)},
+		"order_by":      {"updated_at"},
+		"sort":          {"asc"},
+		"per_page":      {"100"},
+	}
+	var found []GitlabPipeline
+	if err = gl.Get(fmt.Sprintf("projects/%d/pipelines", id), query, &found); err != nil {
+		return nil, err
+	}
+
+	for _, pipeline := range found {
+		if pipeline.Updated_At.After(since) {
+			gl.PipelinesSince[id] = pipeline.Updated_At
+		}
+		// A pipeline that's retried finishes more than once
+		if gl.SeenPipelines.Add(fmt.Sprintf("%d:%s", pipeline.Id, pipeline.Status)) {
+			pipelines = append(pipelines, pipeline)
+		}
+	}
+
+	return pipelines, nil
+}
+
+// Poll returns every project's new events.
+func (gl *Gitlab) Poll() (events []*GitlabEvent, err error) {
+	if gl.Projects == nil || time.Since(gl.ProjectsLoaded) > gitlabProjectsRefresh {
+		if err = gl.LoadProjects(); err != nil {
+			return
+		}
+	}
+
+	for id, project := range gl.Projects {
+		var found []GitlabApiEvent
+		if found, err = gl.FetchEvents(id); err != nil {
+			return
+		}
+		for i := range found {
+			events = append(events, found[i].Event(project))
+		}
+
+		if !gl.Pipelines {
+			continue
+		}
+		var pipelines []GitlabPipeline
+		if pipelines, err = gl.FetchPipelines(id); err != nil {
+			return
+		}
+		for _, pipeline := range pipelines {
+			events = append(events, &GitlabEvent{
+				Type:    "PipelineEvent",
+				Action:  pipeline.Status,
+				Project: project,
+				Ref:     pipeline.Ref,
+				Iid:     pipeline.Id,
+			})
+		}
+	}
+
+	return
+}
+
+func (gl *Gitlab) Run(conductor chan *choir.Note) {
+	if gl.Choir == nil {
+		return
+	}
+
+	for {
+		events, err := gl.Poll()
+
+		for _, event := range events {
+			if !event.Worth() {
+				continue
+			}
+
+			note := &choir.Note{
+				Label: event.GetCategory(),
+				Sound: event.SoundClass(),
+				Text:  notetext.Render(event.GetTitle(), gl.Choir.Format),
+				Choir: gl.Choir,
+			}
+
+			go func() {
+				conductor <- note
+			}()
+		}
+
+		time.Sleep(gl.Health.Observe(err, gl.Interval, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered GitLab")
+	RegisterFactory("gitlab", func() Servicer { return &Gitlab{} })
+}
@@ -0,0 +1,207 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// Webhook object kinds and the event types they sound like
+var gitlabWebhookEvents = map[string]string{
+	"push":          "PushEvent",
+	"tag_push":      "TagPushEvent",
+	"merge_request": "MergeRequestEvent",
+	"issue":         "IssueEvent",
+	"note":          "NoteEvent",
+	"pipeline":      "PipelineEvent",
+}
+
+// Webhook actions and the events API words for them
+var gitlabWebhookActions = map[string]string{
+	"open":     "opened",
+	"close":    "closed",
+	"reopen":   "reopened",
+	"merge":    "merged",
+	"update":   "updated",
+	"approved": "approved",
+}
+
+// A commit id of all zeros means the ref was created or deleted
+const gitlabBlankSha = "0000000000000000000000000000000000000000"
+
+type GitlabWebhook struct {
+	Path   string
+	Token  string
+	Choir  *choir.Choir
+	Notes  chan *choir.Note
+	Events *RecentSet
+}
+
+type GitlabWebhookConfig struct {
+	Type   string
+	Key    string
+	Format string
+	Path   string
+	Token  string
+}
+
+type GitlabWebhookPayload struct {
+	Object_Kind         string
+	User_Username       string
+	Ref                 string
+	Before              string
+	After               string
+	Total_Commits_Count int
+	User                struct {
+		Username string
+	}
+	Project struct {
+		Path_With_Namespace string
+	}
+	Object_Attributes struct {
+		Id            int
+		Iid           int
+		Title         string
+		Action        string
+		Status        string
+		Ref           string
+		Note          string
+		Noteable_Type string
+	}
+	Merge_Request struct {
+		Iid int
+	}
+	Issue struct {
+		Iid int
+	}
+}
+
+// Event turns a delivery into the shape the events API poller uses so
+// it's described and voiced exactly the same.
+func (p *GitlabWebhookPayload) Event() *GitlabEvent {
+	attrs := p.Object_Attributes
+	event := &GitlabEvent{
+		Type:    gitlabWebhookEvents[p.Object_Kind],
+		Actor:   pickString(p.User_Username, p.User.Username),
+		Project: p.Project.Path_With_Namespace,
+		Iid:     attrs.Iid,
+		Title:   attrs.Title,
+		Action:  pickString(gitlabWebhookActions[attrs.Action], attrs.Action),
+	}
+
+	switch p.Object_Kind {
+	case "push", "tag_push":
+		event.Ref = strings.TrimPrefix(strings.TrimPrefix(p.Ref, "refs/heads/"), "refs/tags/")
+		event.Commits = p.Total_Commits_Count
+		switch {
+		case p.After == gitlabBlankSha:
+			event.Action = "deleted"
+		case p.Before == gitlabBlankSha || p.Object_Kind == "tag_push":
+			event.Action = "created"
+		default:
+			event.Action = "pushed"
+		}
+	case "note":
+		event.Noteable = attrs.Noteable_Type
+		event.Body = attrs.Note
+		event.Iid = p.Merge_Request.Iid
+		if attrs.Noteable_Type == "Issue" {
+			event.Iid = p.Issue.Iid
+		}
+	case "pipeline":
+		event.Action = attrs.Status
+		event.Ref = attrs.Ref
+		event.Iid = attrs.Id
+	}
+
+	return event
+}
+
+func (gw *GitlabWebhook) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject GitlabWebhookConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	gw.Path = configObject.Path
+	if gw.Path == "" {
+		gw.Path = "/gitlab"
+	}
+	gw.Token = configObject.Token
+	gw.Choir = choir.NewChoir(configObject.Key)
+	gw.Choir.Format = notetext.ParseFormat(configObject.Format)
+	gw.Notes = make(chan *choir.Note, 100)
+	gw.Events = NewRecentSet(1000)
+
+	if gw.Token == "" {
+		log.Printf("ERR gitlab_webhook has no token, deliveries can't be verified")
+	}
+
+	HandleInbound("GitLab webhook", gw.Path, gw)
+
+	fmt.Printf("Configured GitLab webhook: %s\n", gw.Path)
+}
+
+func (gw *GitlabWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := ReadInbound(w, r)
+	if !ok {
+		return
+	}
+
+	if !ValidToken(gw.Token, r.Header.Get("X-Gitlab-Token")) {
+		log.Printf("ERR GitLab webhook with a bad token from %s", r.RemoteAddr)
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+
+	// GitLab retries deliveries that time out
+	delivery := r.Header.Get("X-Gitlab-Event-UUID")
+	if delivery != "" && !gw.Events.Add(delivery) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var payload GitlabWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("ERR decoding GitLab webhook: %s", err)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	if note := gw.BuildNote(payload.Event()); note != nil {
+		gw.Notes <- note
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// BuildNote returns nil for events we don't know or don't sing about.
+func (gw *GitlabWebhook) BuildNote(event *GitlabEvent) *choir.Note {
+	if !event.Worth() {
+		return nil
+	}
+
+	return &choir.Note{
+		Label: event.GetCategory(),
+		Sound: event.SoundClass(),
+		Text:  notetext.Render(event.GetTitle(), gw.Choir.Format),
+		Choir: gw.Choir,
+	}
+}
+
+func (gw *GitlabWebhook) Run(conductor chan *choir.Note) {
+	for note := range gw.Notes {
+		conductor <- note
+	}
+}
+
+func init() {
+	fmt.Println("Registered GitLab webhook")
+	RegisterFactory("gitlab_webhook", func() Servicer { return &GitlabWebhook{} })
+}
@@ -0,0 +1,332 @@
+package ensemble
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// Servers ping every few minutes, so a connection this quiet is dead
+const ircReadTimeout = 5 * time.Minute
+
+// How long to wait before reconnecting, growing while the server keeps
+// dropping us
+const ircReconnect = 10 * time.Second
+
+// AUTHENTICATE payloads are sent in chunks of this many bytes
+const ircSaslChunk = 400
+
+// Bold, colours, italics and the rest of mIRC's formatting codes
+var ircFormatting = regexp.MustCompile(`\x03(\d{1,2}(,\d{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]`)
+
+// IRC joins channels on an IRC network, over TLS unless told otherwise, and
+// sings what's said in them.
+type IRC struct {
+	Name     string
+	Server   string
+	TLS      bool
+	Nick     string
+	Username string
+	Realname string
+	Password string
+	Sasl     IRCSasl
+	Channels []string
+	Quiet    bool
+	Choir    *choir.Choir
+	Health   SourceHealth
+	Activity *ChatActivity
+}
+
+type IRCSasl struct {
+	Username string
+	Password string
+}
+
+type IRCConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Name     string
+	Server   string
+	Tls      *bool
+	Nick     string
+	Username string
+	Realname string
+	Password string
+	Sasl     IRCSasl
+	Channels []string
+	Quiet    bool
+	Activity int
+}
+
+// IRCMessage is one line from the server, e.g.
+// ":alice!a@example.com PRIVMSG #go :hello" is from alice with params
+// "#go" and "hello".
+type IRCMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// ParseIRC splits a line into its prefix, command and params. IRCv3 tags
+// are dropped.
+func ParseIRC(line string) (msg IRCMessage) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		if i := strings.Index(line, " "); i >= 0 {
+			line = strings.TrimLeft(line[i:], " ")
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		parts := strings.SplitN(line[1:], " ", 2)
+		msg.Prefix = parts[0]
+		line = ""
+		if len(parts) > 1 {
+			line = parts[1]
+		}
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if msg.Command == "" {
+			msg.Command = strings.ToUpper(parts[0])
+		} else if parts[0] != "" {
+			msg.Params = append(msg.Params, parts[0])
+		}
+		line = ""
+		if len(parts) > 1 {
+			line = parts[1]
+		}
+	}
+
+	return
+}
+
+// Nick is who sent the message.
+func (msg IRCMessage) Nick() string {
+	return strings.SplitN(msg.Prefix, "!", 2)[0]
+}
+
+// Param returns the i'th param, or "" if there aren't that many.
+func (msg IRCMessage) Param(i int) string {
+	if i < len(msg.Params) {
+		return msg.Params[i]
+	}
+	return ""
+}
+
+func (irc *IRC) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject IRCConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Server == "" || configObject.Nick == "" || len(configObject.Channels) == 0 {
+		log.Printf("ERR irc source needs a server, nick and channels")
+		return
+	}
+
+	irc.TLS = configObject.Tls == nil || *configObject.Tls
+	irc.Server = configObject.Server
+	if _, _, err := net.SplitHostPort(irc.Server); err != nil {
+		port := "6697"
+		if !irc.TLS {
+			port = "6667"
+		}
+		irc.Server = net.JoinHostPort(irc.Server, port)
+	}
+
+	irc.Nick = configObject.Nick
+	irc.Username = pickString(configObject.Username, configObject.Nick)
+	irc.Realname = pickString(configObject.Realname, "choirmaster")
+	irc.Password = configObject.Password
+	irc.Sasl = configObject.Sasl
+	irc.Channels = configObject.Channels
+	irc.Quiet = configObject.Quiet
+
+	irc.Name = pickString(configObject.Name, irc.Server)
+	irc.Choir = choir.NewChoir(configObject.Key)
+	irc.Choir.Format = notetext.ParseFormat(configObject.Format)
+	irc.Health = SourceHealth{Name: irc.Name, Choir: irc.Choir}
+	if configObject.Activity > 0 {
+		irc.Activity = NewChatActivity("IRC", time.Duration(configObject.Activity)*time.Second, irc.Choir)
+	}
+
+	fmt.Printf("Configured IRC: %s %s\n", irc.Name, strings.Join(irc.Channels, ","))
+}
+
+func (irc *IRC) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !irc.TLS {
+		return dialer.Dial("tcp", irc.Server)
+	}
+
+	host, _, _ := net.SplitHostPort(irc.Server)
+	return tls.DialWithDialer(dialer, "tcp", irc.Server, &tls.Config{ServerName: host})
+}
+
+// saslPlain is the AUTHENTICATE PLAIN payload, split into lines. A payload
+// that fills its last chunk exactly is followed by an empty "+".
+func saslPlain(username, password string) []string {
+	payload := base64.StdEncoding.EncodeToString([]byte(username + "\x00" + username + "\x00" + password))
+
+	chunks := make([]string, 0)
+	for len(payload) >= ircSaslChunk {
+		chunks = append(chunks, payload[:ircSaslChunk])
+		payload = payload[ircSaslChunk:]
+	}
+	return append(chunks, pickString(payload, "+"))
+}
+
+// Hear returns a note for something said in one of our channels, or nil.
+// Private messages and CTCP requests other than actions are skipped.
+func (irc *IRC) Hear(msg IRCMessage) *choir.Note {
+	channel, text := "", msg.Param(1)
+	for _, c := range irc.Channels {
+		// Channel names are case insensitive, labels use the configured case
+		if strings.EqualFold(c, msg.Param(0)) {
+			channel = c
+		}
+	}
+	if channel == "" {
+		return nil
+	}
+
+	action := false
+	if strings.HasPrefix(text, "\x01") {
+		if !strings.HasPrefix(text, "\x01ACTION ") {
+			return nil
+		}
+		text, action = strings.Trim(text[len("\x01ACTION "):], "\x01"), true
+	}
+	text = ircFormatting.ReplaceAllString(text, "")
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	if irc.Activity != nil {
+		irc.Activity.Count(channel, msg.Nick())
+	}
+	if irc.Quiet {
+		return nil
+	}
+
+	return chatNote("IRC", channel, msg.Nick(), text, action, irc.Choir)
+}
+
+// Session connects, registers and listens until the connection drops,
+// returning why it did.
+func (irc *IRC) Session(conductor chan *choir.Note) error {
+	conn, err := irc.dial()
+	if err != nil {
+		log.Printf("ERR connecting to %s: %s", irc.Server, err)
+		return err
+	}
+	defer conn.Close()
+
+	send := func(format string, args ...interface{}) {
+		conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	authFailed := &StatusError{Source: irc.Name, Url: irc.Server, Code: http.StatusUnauthorized}
+
+	if irc.Sasl.Username != "" {
+		send("CAP REQ :sasl")
+	}
+	if irc.Password != "" {
+		send("PASS %s", irc.Password)
+	}
+	nick := irc.Nick
+	send("NICK %s", nick)
+	send("USER %s 0 * :%s", irc.Username, irc.Realname)
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			log.Printf("ERR reading from %s: %s", irc.Server, err)
+			return err
+		}
+
+		msg := ParseIRC(line)
+		switch msg.Command {
+		case "PING":
+			send("PONG :%s", msg.Param(0))
+		case "CAP":
+			switch {
+			case msg.Param(1) == "ACK" && strings.Contains(msg.Param(2), "sasl"):
+				send("AUTHENTICATE PLAIN")
+			case msg.Param(1) == "NAK":
+				log.Printf("ERR %s doesn't support SASL", irc.Server)
+				return authFailed
+			}
+		case "AUTHENTICATE":
+			if msg.Param(0) == "+" {
+				for _, chunk := range saslPlain(irc.Sasl.Username, irc.Sasl.Password) {
+					send("AUTHENTICATE %s", chunk)
+				}
+			}
+		case "903":
+			send("CAP END")
+		case "464", "902", "904", "905", "906", "908":
+			log.Printf("ERR %s rejected our login: %s", irc.Server, msg.Param(len(msg.Params)-1))
+			return authFailed
+		case "433":
+			// Nick in use, probably by our own ghost
+			nick += "_"
+			send("NICK %s", nick)
+		case "001":
+			irc.Health.Observe(nil, 0, conductor)
+			send("JOIN %s", strings.Join(irc.Channels, ","))
+		case "471", "473", "474", "475":
+			log.Printf("ERR couldn't join %s on %s: %s", msg.Param(1), irc.Server, msg.Param(2))
+		case "PRIVMSG":
+			if note := irc.Hear(msg); note != nil {
+				conductor <- note
+			}
+		case "ERROR":
+			log.Printf("ERR %s closed the connection: %s", irc.Server, msg.Param(0))
+			return fmt.Errorf("%s: %s", irc.Server, msg.Param(0))
+		}
+	}
+}
+
+func (irc *IRC) Run(conductor chan *choir.Note) {
+	if irc.Server == "" {
+		return
+	}
+
+	if irc.Activity != nil {
+		go irc.Activity.Sing(conductor)
+	}
+
+	for {
+		err := irc.Session(conductor)
+		time.Sleep(irc.Health.Observe(err, ircReconnect, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered IRC")
+	RegisterFactory("irc", func() Servicer { return &IRC{} })
+}
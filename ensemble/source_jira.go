@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dacort/choirmaster/choir"
@@ -17,18 +20,54 @@ type Jira struct {
 	Password   string
 	Choir      *choir.Choir
 	LastUpdate time.Time
+	Health     SourceHealth
+	Categories []string
+
+	// REST search mode, see source_jira_rest.go
+	Mode         string
+	BaseUrl      string
+	Jql          string
+	PollInterval time.Duration
+	Seen         *RecentSet
 }
 
 type JiraConfig struct {
-	Type string
-	Key  string
-	Http struct {
+	Type    string
+	Key     string
+	Mode    string
+	Jql     string
+	Filters JiraFilters
+	Http    struct {
 		Domain   string
 		Username string
 		Password string
 	}
 }
 
+// JiraFilters narrow down the activity feed. Projects and users are passed
+// to JIRA as streams filters, categories are activity terms like "comment".
+type JiraFilters struct {
+	Projects         []string
+	Exclude_Projects []string
+	Users            []string
+	Categories       []string
+}
+
+// Streams returns the activity feed's streams parameters for the filters.
+func (jf *JiraFilters) Streams() []string {
+	streams := make([]string, 0)
+	if len(jf.Projects) > 0 {
+		streams = append(streams, "key IS "+strings.Join(jf.Projects, " "))
+	}
+	if len(jf.Exclude_Projects) > 0 {
+		streams = append(streams, "key NOT "+strings.Join(jf.Exclude_Projects, " "))
+	}
+	if len(jf.Users) > 0 {
+		streams = append(streams, "user IS "+strings.Join(jf.Users, " "))
+	}
+	return streams
+}
+
 // XML Activity Feed
 type JiraFeed struct {
 	XMLName        xml.Name    `xml:"feed"`
@@ -37,8 +76,29 @@ type JiraFeed struct {
 	Entry          []JiraEntry `xml:"entry"`
 }
 
+// Location returns the feed's timezone, UTC if it doesn't give one. The
+// offset looks like "-0700", "-07:00" or, on some servers, minutes.
+func (jf *JiraFeed) Location() *time.Location {
+	offset := strings.TrimSpace(jf.TimezoneOffset)
+	if offset == "" {
+		return time.UTC
+	}
+
+	if minutes, err := strconv.Atoi(offset); err == nil && len(strings.TrimLeft(offset, "+-")) < 4 {
+		return time.FixedZone(offset, minutes*60)
+	}
+
+	if parsed, err := time.Parse("-0700", strings.Replace(offset, ":", "", 1)); err == nil {
+		_, seconds := parsed.Zone()
+		return time.FixedZone(offset, seconds)
+	}
+
+	log.Printf("ERR unknown JIRA timezone offset %q, assuming UTC", offset)
+	return time.UTC
+}
+
 type JiraEntry struct {
-	Published time.Time `xml:"published"`
+	Published string `xml:"published"`
 	Category  struct {
 		Term string `xml:"term,attr"`
 	} `xml:"category"`
@@ -46,6 +106,24 @@ type JiraEntry struct {
 	Title      string `xml:"title"`
 }
 
+// PublishedAt parses the entry's timestamp. Entries carrying their own
+// offset use it, ones without are in the feed's timezone.
+func (je *JiraEntry) PublishedAt(loc *time.Location) (time.Time, error) {
+	published := strings.TrimSpace(je.Published)
+
+	if t, err := time.Parse(time.RFC3339Nano, published); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04:05.000-0700", "2006-01-02T15:04:05-0700"} {
+		if t, err := time.Parse(layout, published); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.ParseInLocation("2006-01-02T15:04:05.999999999", published, loc)
+}
+
 func (j *Jira) Configure(config interface{}) {
 	// This seems innane but it's the only way I can figure it out
 	jsonString, _ := json.Marshal(config)
@@ -55,15 +133,33 @@ func (j *Jira) Configure(config interface{}) {
 		return
 	}
 
-	j.Url = fmt.Sprintf("https://%s/activity?maxResults=20&os_authType=basic&title=undefined", configObject.Http.Domain)
+	params := url.Values{
+		"maxResults":  {"20"},
+		"os_authType": {"basic"},
+		"title":       {"undefined"},
+		"streams":     configObject.Filters.Streams(),
+	}
+	j.Url = fmt.Sprintf("https://%s/activity?%s", configObject.Http.Domain, params.Encode())
+	j.Categories = configObject.Filters.Categories
 	j.Username = fmt.Sprintf("%s", configObject.Http.Username)
 	j.Password = fmt.Sprintf("%s", configObject.Http.Password)
-	j.Choir = &choir.Choir{configObject.Key}
+	j.Choir = choir.NewChoir(configObject.Key)
+	j.Health = SourceHealth{Name: "JIRA", Choir: j.Choir}
+
+	j.Mode = configObject.Mode
+	if j.Mode == "rest" {
+		j.BaseUrl = fmt.Sprintf("https://%s", configObject.Http.Domain)
+		j.Jql = configObject.Jql
+		j.PollInterval = jiraRestPollInterval
+		j.Seen = NewRecentSet(5000)
+		fmt.Printf("Configured JIRA REST search: %s\n", pickString(j.Jql, "all issues"))
+		return
+	}
 
 	fmt.Printf("Configured JIRA: %s\n", configObject.Http.Domain)
 }
 
-func (j *Jira) FetchUpdates() (feed JiraFeed) {
+func (j *Jira) FetchUpdates() (feed JiraFeed, err error) {
 	req, err := http.NewRequest("GET", j.Url, nil)
 	if err != nil {
 		log.Printf("ERR building request: %s", err)
@@ -77,16 +173,9 @@ func (j *Jira) FetchUpdates() (feed JiraFeed) {
 		log.Printf("ERR making request: %s", err)
 		return
 	}
+	defer resp.Body.Close()
 
-	dec := xml.NewDecoder(resp.Body)
-	err = dec.Decode(&feed)
-	if err != nil {
-		log.Printf("ERR decoding json from JIRA: %s\n%s", err, resp.Body)
-		return
-	}
-
-	resp.Body.Close()
-
+	err = DecodeXML("JIRA", resp, &feed)
 	return
 }
 
@@ -110,21 +199,41 @@ func SoundClass(category string) string {
 }
 
 func (j *Jira) Run(conductor chan *choir.Note) {
+	if j.Mode == "rest" {
+		j.RunRest(conductor)
+		return
+	}
+
 	for {
-		feed := j.FetchUpdates()
+		feed, err := j.FetchUpdates()
+		loc := feed.Location()
+
+		// Entries are newest first, so compare them all with where the
+		// last poll got to rather than with each other
+		since := j.LastUpdate
 
 		for _, entry := range feed.Entry {
+			published, perr := entry.PublishedAt(loc)
+			if perr != nil {
+				log.Printf("ERR parsing JIRA timestamp %q: %s", entry.Published, perr)
+				continue
+			}
 
-			if entry.Published.Before(j.LastUpdate) {
+			if published.Before(since) {
 				continue
-			} else {
-				j.LastUpdate = entry.Published.Add(1 * time.Second)
+			}
+			if !published.Before(j.LastUpdate) {
+				j.LastUpdate = published.Add(1 * time.Second)
 			}
 
 			if entry.Category.Term == "" {
 				entry.Category.Term = "changed"
 			}
 
+			if len(j.Categories) > 0 && !containsFold(j.Categories, entry.Category.Term) {
+				continue
+			}
+
 			note := &choir.Note{
 				Label: fmt.Sprintf("JIRA:%s", entry.Category.Term),
 				Sound: SoundClass(entry.Category.Term),
@@ -137,7 +246,7 @@ func (j *Jira) Run(conductor chan *choir.Note) {
 			}()
 		}
 
-		time.Sleep(5 * time.Second)
+		time.Sleep(j.Health.Observe(err, 5*time.Second, conductor))
 	}
 }
 
@@ -0,0 +1,306 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const jiraSearchPath = "/rest/api/2/search"
+
+// Issues per page of search results
+const jiraPageSize = 50
+
+// How far each search reaches back before the last good poll, so issues
+// updated while it ran are found by the next. Overlaps are deduplicated.
+const jiraSearchOverlap = time.Minute
+
+const jiraRestPollInterval = 30 * time.Second
+
+// The fields whose changes we sing about
+var jiraWatchedFields = []string{"status", "resolution", "assignee", "priority"}
+
+// JiraTime reads the REST API's timestamps: "2013-09-20T18:40:57.000+0000"
+type JiraTime struct {
+	time.Time
+}
+
+func (t *JiraTime) UnmarshalJSON(data []byte) error {
+	const longForm = "2006-01-02T15:04:05.000-0700"
+	timestamp := strings.Trim(string(data), "\"")
+	if timestamp == "" || timestamp == "null" {
+		return nil
+	}
+
+	parsed, err := time.Parse(longForm, timestamp)
+	if err != nil {
+		parsed, err = time.Parse(time.RFC3339, timestamp)
+	}
+	if err != nil {
+		log.Printf("Could not unmarshal JIRA time %s", timestamp)
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+type JiraSearch struct {
+	StartAt    int
+	MaxResults int
+	Total      int
+	Issues     []JiraIssue
+}
+
+type JiraIssue struct {
+	Key    string
+	Fields struct {
+		Summary string
+		Created JiraTime
+		Updated JiraTime
+		Status  struct {
+			Name string
+		}
+	}
+	Changelog struct {
+		Histories []JiraHistory
+	}
+}
+
+type JiraUser struct {
+	DisplayName string
+	Name        string
+}
+
+type JiraHistory struct {
+	Id      json.Number
+	Author  JiraUser
+	Created JiraTime
+	Items   []JiraChangeItem
+}
+
+// JiraChangeItem is a single field changing in an issue's changelog.
+type JiraChangeItem struct {
+	Field      string
+	FromString string
+	ToString   string
+}
+
+// Term maps a change onto the category terms the activity stream uses, so
+// it gets the same label and sound as the Atom source gives it.
+func (ci *JiraChangeItem) Term() string {
+	switch strings.ToLower(ci.Field) {
+	case "status":
+		return JiraStatusTerm(ci.FromString, ci.ToString)
+	case "resolution":
+		if ci.ToString != "" {
+			return "resolved"
+		}
+	}
+	return "changed"
+}
+
+// JiraStatusTerm turns a workflow transition into an activity stream term.
+func JiraStatusTerm(from string, to string) string {
+	switch strings.ToLower(to) {
+	case "in progress":
+		return "started"
+	case "resolved", "done":
+		return "resolved"
+	case "closed":
+		return "closed"
+	case "reopened":
+		return "reopened"
+	case "open", "to do":
+		switch strings.ToLower(from) {
+		case "resolved", "done", "closed":
+			return "reopened"
+		}
+	}
+	return "changed"
+}
+
+func (ci *JiraChangeItem) Describe() string {
+	from := ci.FromString
+	if from == "" {
+		from = "nothing"
+	}
+	to := ci.ToString
+	if to == "" {
+		to = "nothing"
+	}
+	return fmt.Sprintf("%s %s → %s", ci.Field, from, to)
+}
+
+func (ju *JiraUser) String() string {
+	if ju.DisplayName != "" {
+		return ju.DisplayName
+	}
+	return ju.Name
+}
+
+// Watched returns the items in the history entry that we care about.
+func (jh *JiraHistory) Watched() []JiraChangeItem {
+	items := make([]JiraChangeItem, 0)
+	for _, item := range jh.Items {
+		if containsFold(jiraWatchedFields, item.Field) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Term picks the most notable term out of the history entry's changes.
+func (jh *JiraHistory) Term() string {
+	term := "changed"
+	for _, item := range jh.Watched() {
+		if t := item.Term(); t != "changed" {
+			term = t
+			if item.Field == "status" {
+				break
+			}
+		}
+	}
+	return term
+}
+
+// BuildJiraNote makes a note for a single change to an issue.
+func BuildJiraNote(c *choir.Choir, key, summary, who, term string, changes []string) *choir.Note {
+	if term == "" {
+		term = "changed"
+	}
+
+	text := fmt.Sprintf("%s %s", key, notetext.Clean(summary, 200))
+	if len(changes) > 0 {
+		text = fmt.Sprintf("%s: %s", text, strings.Join(changes, ", "))
+	}
+	if who != "" {
+		text = fmt.Sprintf("%s (%s)", text, who)
+	}
+
+	return &choir.Note{
+		Label: fmt.Sprintf("JIRA:%s", term),
+		Sound: SoundClass(term),
+		Text:  notetext.Render(text, c.Format),
+		Choir: c,
+	}
+}
+
+// SearchJql adds the window since the last good poll to the configured JQL.
+// The window is in minutes before now, as JIRA reads absolute dates in the
+// user's own timezone.
+func (j *Jira) SearchJql() string {
+	minutes := int(math.Ceil(time.Since(j.LastUpdate.Add(-jiraSearchOverlap)).Minutes()))
+	window := fmt.Sprintf("updated >= -%dm ORDER BY updated ASC", minutes)
+	if j.Jql == "" {
+		return window
+	}
+	return fmt.Sprintf("(%s) AND %s", j.Jql, window)
+}
+
+// Search runs the configured JQL over the window since the last good poll,
+// following every page of results.
+func (j *Jira) Search() (issues []JiraIssue, err error) {
+	startAt := 0
+	jql := j.SearchJql()
+
+	for {
+		params := url.Values{
+			"jql":        {jql},
+			"startAt":    {fmt.Sprintf("%d", startAt)},
+			"maxResults": {fmt.Sprintf("%d", jiraPageSize)},
+			"fields":     {"summary,status,created,updated"},
+			"expand":     {"changelog"},
+		}
+
+		var page JiraSearch
+		if err = j.GetRest(jiraSearchPath+"?"+params.Encode(), &page); err != nil {
+			return
+		}
+
+		issues = append(issues, page.Issues...)
+		startAt += len(page.Issues)
+		if len(page.Issues) == 0 || startAt >= page.Total {
+			return
+		}
+	}
+}
+
+func (j *Jira) GetRest(path string, decode_object interface{}) error {
+	req, err := http.NewRequest("GET", j.BaseUrl+path, nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return err
+	}
+
+	req.SetBasicAuth(j.Username, j.Password)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("ERR making request: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return DecodeJSON("JIRA", resp, decode_object)
+}
+
+// IssueNotes returns a note for the issue being created after since, and one
+// for each later history entry that changed a field we watch.
+func (j *Jira) IssueNotes(issue JiraIssue, since time.Time) []*choir.Note {
+	notes := make([]*choir.Note, 0)
+
+	if issue.Fields.Created.After(since) && j.Seen.Add(issue.Key+":created") {
+		notes = append(notes, BuildJiraNote(j.Choir, issue.Key, issue.Fields.Summary, "", "created", nil))
+	}
+
+	for _, history := range issue.Changelog.Histories {
+		if !history.Created.After(since) || !j.Seen.Add(issue.Key+":"+history.Id.String()) {
+			continue
+		}
+
+		watched := history.Watched()
+		if len(watched) == 0 {
+			continue
+		}
+
+		changes := make([]string, 0, len(watched))
+		for _, item := range watched {
+			changes = append(changes, item.Describe())
+		}
+		notes = append(notes, BuildJiraNote(j.Choir, issue.Key, issue.Fields.Summary, history.Author.String(), history.Term(), changes))
+	}
+
+	return notes
+}
+
+func (j *Jira) RunRest(conductor chan *choir.Note) {
+	for {
+		polled := time.Now()
+		issues, err := j.Search()
+
+		for _, issue := range issues {
+			for _, note := range j.IssueNotes(issue, j.LastUpdate) {
+				note := note
+				go func() {
+					conductor <- note
+				}()
+			}
+		}
+
+		// However long we were backing off, the next search starts here
+		if err == nil {
+			j.LastUpdate = polled
+		}
+
+		time.Sleep(j.Health.Observe(err, j.PollInterval, conductor))
+	}
+}
@@ -0,0 +1,173 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+type JiraWebhook struct {
+	Path       string
+	Token      string
+	Choir      *choir.Choir
+	Notes      chan *choir.Note
+	Deliveries *RecentSet
+}
+
+type JiraWebhookConfig struct {
+	Type  string
+	Key   string
+	Path  string
+	Token string
+}
+
+type JiraWebhookPayload struct {
+	WebhookEvent          string
+	Issue_Event_Type_Name string
+	User                  JiraUser
+	Issue                 JiraIssue
+	Changelog             JiraHistory
+	Comment               struct {
+		Body   string
+		Author JiraUser
+	}
+	Sprint struct {
+		Name  string
+		State string
+	}
+}
+
+// Term works out the activity stream term for the delivery, so webhook
+// notes sound the same as the ones the Atom source makes.
+func (p *JiraWebhookPayload) Term() string {
+	switch strings.TrimPrefix(p.WebhookEvent, "jira:") {
+	case "issue_created":
+		return "created"
+	case "comment_created", "comment_updated":
+		return "comment"
+	case "sprint_created":
+		return "created"
+	case "sprint_started":
+		return "started"
+	case "sprint_closed":
+		return "closed"
+	case "issue_updated":
+		if p.Issue_Event_Type_Name == "issue_commented" {
+			return "comment"
+		}
+		return p.Changelog.Term()
+	default:
+		return ""
+	}
+}
+
+func (jw *JiraWebhook) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject JiraWebhookConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	jw.Path = configObject.Path
+	if jw.Path == "" {
+		jw.Path = "/jira"
+	}
+	jw.Token = configObject.Token
+	jw.Choir = choir.NewChoir(configObject.Key)
+	jw.Notes = make(chan *choir.Note, 100)
+	jw.Deliveries = NewRecentSet(1000)
+
+	HandleInbound("JIRA webhook", jw.Path, jw)
+
+	fmt.Printf("Configured JIRA webhook: %s\n", jw.Path)
+}
+
+func (jw *JiraWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := ReadInbound(w, r)
+	if !ok {
+		return
+	}
+
+	// JIRA can't sign deliveries, so the best we can do is a secret in the URL
+	if jw.Token != "" && !ValidToken(jw.Token, r.URL.Query().Get("token")) {
+		log.Printf("ERR JIRA webhook with a bad token from %s", r.RemoteAddr)
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+
+	delivery := r.Header.Get("X-Atlassian-Webhook-Identifier")
+	if delivery != "" && !jw.Deliveries.Add(delivery) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var payload JiraWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("ERR decoding JIRA webhook: %s", err)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	if note := jw.BuildNote(&payload); note != nil {
+		jw.Notes <- note
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// BuildNote returns nil for events we don't sing about, like issue updates
+// that didn't touch a field we watch.
+func (jw *JiraWebhook) BuildNote(p *JiraWebhookPayload) *choir.Note {
+	term := p.Term()
+	if term == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(p.WebhookEvent, "sprint_") {
+		text := fmt.Sprintf("Sprint %s %s", p.Sprint.Name, strings.TrimPrefix(p.WebhookEvent, "sprint_"))
+		return &choir.Note{
+			Label: fmt.Sprintf("JIRA:%s", term),
+			Sound: SoundClass(term),
+			Text:  notetext.Render(text, jw.Choir.Format),
+			Choir: jw.Choir,
+		}
+	}
+
+	who := p.User.String()
+	changes := make([]string, 0)
+
+	switch term {
+	case "comment":
+		if p.Comment.Author.String() != "" {
+			who = p.Comment.Author.String()
+		}
+		changes = append(changes, notetext.Clean(p.Comment.Body, 200))
+	case "created":
+	default:
+		watched := p.Changelog.Watched()
+		if len(watched) == 0 {
+			return nil
+		}
+		for _, item := range watched {
+			changes = append(changes, item.Describe())
+		}
+	}
+
+	return BuildJiraNote(jw.Choir, p.Issue.Key, p.Issue.Fields.Summary, who, term, changes)
+}
+
+func (jw *JiraWebhook) Run(conductor chan *choir.Note) {
+	for note := range jw.Notes {
+		conductor <- note
+	}
+}
+
+func init() {
+	fmt.Println("Registered JIRA webhook")
+	RegisterFactory("jira_webhook", func() Servicer { return &JiraWebhook{} })
+}
@@ -0,0 +1,330 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const jsonPollDefaultInterval = 60 * time.Second
+
+// Placeholder for the cursor in a json_poll url or body
+const jsonPollCursor = "{cursor}"
+
+var jsonPollDefaultTemplate = NoteTemplate{
+	Label: "{{.source}}",
+	Sound: "n/0",
+	Text:  "{{.item}}",
+}
+
+// JsonPoll polls any JSON API, configured entirely in config.json.
+type JsonPoll struct {
+	Name     string
+	Url      string
+	Method   string
+	Body     string
+	Headers  map[string]string
+	Username string
+	Password string
+	Token    string
+	Interval time.Duration
+	Client   *http.Client
+
+	Items           string
+	Id              string
+	Timestamp       string
+	TimestampLayout string
+
+	// The cursor is the newest item's id or timestamp, sent with the next
+	// poll so the API only returns what's new.
+	Cursor      string
+	CursorFrom  string
+	CursorParam string
+
+	Choir  *choir.Choir
+	Health SourceHealth
+	Notes  *NoteMaker
+	Seen   *RecentSet
+	Primed bool
+}
+
+type JsonPollConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Name     string
+	Url      string
+	Method   string
+	Body     string
+	Headers  map[string]string
+	Interval int
+	Http     struct {
+		Username string
+		Password string
+		Token    string
+	}
+
+	// Paths into the response
+	Items            string
+	Id               string
+	Timestamp        string
+	Timestamp_Layout string
+
+	Cursor struct {
+		From    string
+		Param   string
+		Initial string
+	}
+
+	NoteTemplate
+}
+
+// JsonPollItem is an item from the response, with the values we found in it.
+type JsonPollItem struct {
+	Data      interface{}
+	Id        string
+	Timestamp time.Time
+}
+
+func (jp *JsonPoll) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject JsonPollConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Url == "" {
+		log.Printf("ERR json_poll source needs a url")
+		return
+	}
+
+	jp.Url = configObject.Url
+	jp.Name = configObject.Name
+	if jp.Name == "" {
+		if parsed, err := url.Parse(jp.Url); err == nil {
+			jp.Name = parsed.Host
+		}
+	}
+	jp.Method = strings.ToUpper(configObject.Method)
+	if jp.Method == "" {
+		jp.Method = "GET"
+	}
+	jp.Body = configObject.Body
+	jp.Headers = configObject.Headers
+	jp.Username = configObject.Http.Username
+	jp.Password = configObject.Http.Password
+	jp.Token = configObject.Http.Token
+	jp.Interval = time.Duration(configObject.Interval) * time.Second
+	if jp.Interval <= 0 {
+		jp.Interval = jsonPollDefaultInterval
+	}
+	jp.Client = &http.Client{Timeout: 30 * time.Second}
+
+	jp.Items = configObject.Items
+	jp.Id = configObject.Id
+	jp.Timestamp = configObject.Timestamp
+	jp.TimestampLayout = configObject.Timestamp_Layout
+
+	jp.CursorFrom = configObject.Cursor.From
+	jp.CursorParam = configObject.Cursor.Param
+	jp.Cursor = configObject.Cursor.Initial
+
+	jp.Choir = choir.NewChoir(configObject.Key)
+	jp.Choir.Format = notetext.ParseFormat(configObject.Format)
+	jp.Health = SourceHealth{Name: jp.Name, Choir: jp.Choir}
+	jp.Seen = NewRecentSet(1000)
+
+	var err error
+	if jp.Notes, err = configObject.NoteTemplate.Compile(jsonPollDefaultTemplate); err != nil {
+		log.Printf("ERR configuring json_poll %s: %s", jp.Name, err)
+		return
+	}
+
+	fmt.Printf("Configured JSON poll: %s\n", jp.Name)
+}
+
+// Request builds the next poll's request, with the cursor filled in.
+func (jp *JsonPoll) Request() (*http.Request, error) {
+	cursor := url.QueryEscape(jp.Cursor)
+	requestUrl := strings.Replace(jp.Url, jsonPollCursor, cursor, -1)
+
+	if jp.CursorParam != "" && jp.Cursor != "" {
+		parsed, err := url.Parse(requestUrl)
+		if err != nil {
+			return nil, err
+		}
+		query := parsed.Query()
+		query.Set(jp.CursorParam, jp.Cursor)
+		parsed.RawQuery = query.Encode()
+		requestUrl = parsed.String()
+	}
+
+	body := strings.Replace(jp.Body, jsonPollCursor, jp.Cursor, -1)
+	req, err := http.NewRequest(jp.Method, requestUrl, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range jp.Headers {
+		req.Header.Set(name, value)
+	}
+	if jp.Username != "" {
+		req.SetBasicAuth(jp.Username, jp.Password)
+	}
+	if jp.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+jp.Token)
+	}
+
+	return req, nil
+}
+
+// FetchUpdates returns the items in the response, oldest first when they
+// have timestamps.
+func (jp *JsonPoll) FetchUpdates() (items []JsonPollItem, err error) {
+	req, err := jp.Request()
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return
+	}
+
+	var response interface{}
+	if err = FetchJSON(jp.Name, jp.Client, req, &response); err != nil {
+		return
+	}
+
+	found, ok := LookupPath(response, jp.Items)
+	if !ok {
+		log.Printf("ERR %s response has nothing at %q", jp.Name, jp.Items)
+		return
+	}
+
+	list, ok := found.([]interface{})
+	if !ok {
+		// A single object is a list of one
+		list = []interface{}{found}
+	}
+
+	for _, data := range list {
+		item := JsonPollItem{Data: data, Id: LookupString(data, jp.Id)}
+		if jp.Timestamp != "" {
+			raw := LookupString(data, jp.Timestamp)
+			if item.Timestamp, err = ParseTimestamp(raw, jp.TimestampLayout); err != nil {
+				log.Printf("ERR %s: %s", jp.Name, err)
+				err = nil
+			}
+		}
+		if item.Id == "" {
+			encoded, _ := json.Marshal(data)
+			item.Id = string(encoded)
+		}
+		items = append(items, item)
+	}
+
+	if jp.Timestamp != "" {
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Timestamp.Before(items[j].Timestamp)
+		})
+	}
+
+	return
+}
+
+// Advance moves the cursor past the newest item.
+func (jp *JsonPoll) Advance(items []JsonPollItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	switch jp.CursorFrom {
+	case "id":
+		jp.Cursor = newestId(jp.Cursor, items)
+	case "timestamp":
+		newest := items[len(items)-1]
+		if !newest.Timestamp.IsZero() {
+			jp.Cursor = LookupString(newest.Data, jp.Timestamp)
+		}
+	}
+}
+
+// newestId returns the largest id when they're all numbers, so the cursor
+// only moves forward, or else the last item's id.
+func newestId(cursor string, items []JsonPollItem) string {
+	newest := cursor
+	newestValue, _ := strconv.ParseFloat(cursor, 64)
+
+	for _, item := range items {
+		value, err := strconv.ParseFloat(item.Id, 64)
+		if err != nil {
+			return items[len(items)-1].Id
+		}
+		if newest == "" || value > newestValue {
+			newest, newestValue = item.Id, value
+		}
+	}
+
+	return newest
+}
+
+func (jp *JsonPoll) Run(conductor chan *choir.Note) {
+	if jp.Notes == nil {
+		return
+	}
+
+	for {
+		items, err := jp.FetchUpdates()
+
+		for _, item := range items {
+			if !jp.Seen.Add(item.Id) || !jp.Primed {
+				continue
+			}
+
+			// The item's own fields can't hide .source or .item
+			data := make(map[string]interface{})
+			if fields, ok := item.Data.(map[string]interface{}); ok {
+				for k, v := range fields {
+					data[k] = v
+				}
+			}
+			data["source"] = jp.Name
+			data["item"] = item.Data
+
+			note, nerr := jp.Notes.Make(jp.Choir, data)
+			if nerr != nil {
+				log.Printf("ERR making note for %s: %s", jp.Name, nerr)
+				continue
+			}
+
+			go func() {
+				conductor <- note
+			}()
+		}
+
+		jp.Advance(items)
+
+		// Whatever the API returns when we start has already happened
+		if err == nil {
+			jp.Primed = true
+		}
+
+		time.Sleep(jp.Health.Observe(err, jp.Interval, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered JSON poll")
+	RegisterFactory("json_poll", func() Servicer { return &JsonPoll{} })
+}
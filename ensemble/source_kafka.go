@@ -0,0 +1,917 @@
+package ensemble
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+// Group timing: how long the coordinator waits to hear from us before
+// handing our partitions to someone else, how long a rebalance may take,
+// and how often we say we're still here
+const (
+	kafkaSessionTimeout   = 30 * time.Second
+	kafkaRebalanceTimeout = 60 * time.Second
+	kafkaHeartbeatEvery   = 3 * time.Second
+)
+
+// How long a fetch waits for records, and most it brings back
+const (
+	kafkaFetchWait  = 500 * time.Millisecond
+	kafkaFetchBytes = 10 << 20
+)
+
+// errKafkaRejoin means the group is rebalancing and we need to join again.
+var errKafkaRejoin = errors.New("kafka group is rebalancing")
+
+// errKafkaMoved means a partition's leader has changed and the metadata
+// needs reading again.
+var errKafkaMoved = errors.New("kafka partition leader has moved")
+
+// How long we give an election before asking who won
+const kafkaMovedWait = time.Second
+
+// Kafka reads topics as a member of a consumer group. Offsets are
+// committed once a record's note has been handed to the conductor, so a
+// restart carries on from the last note sung rather than missing records
+// or singing a backlog. Sample sings one in every N notes on a topic.
+type Kafka struct {
+	Bus
+
+	Brokers []string
+	TLS     bool
+	SASL    KafkaSASL
+	Group   string
+	Topics  []string
+	Start   string
+	Sample  map[string]int
+
+	member  string
+	sampled map[string]int
+}
+
+// KafkaSASL is a username and password for SASL/PLAIN.
+type KafkaSASL struct {
+	Username string
+	Password string
+}
+
+type KafkaConfig struct {
+	Type    string
+	Brokers []string
+	Tls     bool
+	Sasl    KafkaSASL
+	Group   string
+	Topics  []string
+	Start   string
+	Sample  map[string]int
+
+	BusConfig
+}
+
+type kafkaPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// kafkaCluster is what the metadata says about the brokers and topics.
+type kafkaCluster struct {
+	Brokers    map[int32]string
+	Partitions map[string][]int32
+	Leaders    map[kafkaPartition]int32
+}
+
+// kafkaSession is one connection to the group, across rebalances.
+type kafkaSession struct {
+	*Kafka
+
+	bootstrap   *kafkaConn
+	coordinator *kafkaConn
+	leaders     map[int32]*kafkaConn
+	cluster     kafkaCluster
+
+	generation int32
+	assigned   []kafkaPartition
+	positions  map[kafkaPartition]int64
+	committed  map[kafkaPartition]int64
+	stuck      map[kafkaPartition]bool
+}
+
+func (k *Kafka) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject KafkaConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if len(configObject.Brokers) == 0 || len(configObject.Topics) == 0 {
+		log.Printf("ERR kafka source needs brokers and topics")
+		return
+	}
+	start := pickString(strings.ToLower(configObject.Start), "latest")
+	if start != "latest" && start != "earliest" {
+		log.Printf("ERR kafka source start should be latest or earliest, not %q", configObject.Start)
+		return
+	}
+
+	var brokers []string
+	for _, broker := range configObject.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			broker = net.JoinHostPort(broker, "9092")
+		}
+		brokers = append(brokers, broker)
+	}
+	group := pickString(configObject.Group, "choirmaster")
+	if !k.configureBus("kafka", configObject.BusConfig, brokers[0]) {
+		return
+	}
+
+	k.Brokers = brokers
+	k.TLS = configObject.Tls
+	k.SASL = configObject.Sasl
+	k.Group = group
+	k.Topics = configObject.Topics
+	k.Start = start
+	k.Sample = configObject.Sample
+	k.sampled = make(map[string]int)
+
+	fmt.Printf("Configured Kafka: %s %s\n", k.Name, strings.Join(k.Topics, ","))
+}
+
+// dial connects to a broker and logs in.
+func (k *Kafka) dial(addr string) (*kafkaConn, error) {
+	conn, err := BusServer{Address: addr, TLS: k.TLS}.Dial()
+	if err != nil {
+		log.Printf("ERR connecting to %s: %s", addr, err)
+		return nil, err
+	}
+	c := &kafkaConn{Addr: addr, conn: conn, reader: bufio.NewReader(conn)}
+	if k.SASL.Username == "" {
+		return c, nil
+	}
+
+	var request kafkaEncoder
+	request.Text("PLAIN")
+	d, err := c.Call(kafkaSaslHandshake, request.buf, 30*time.Second)
+	if err == nil {
+		code := d.Int16()
+		if d.err == nil {
+			err = kafkaCheck(code)
+		}
+	}
+	if err == nil {
+		request = kafkaEncoder{}
+		request.Bytes([]byte("\x00" + k.SASL.Username + "\x00" + k.SASL.Password))
+		if d, err = c.Call(kafkaSaslAuthenticate, request.buf, 30*time.Second); err == nil {
+			code := d.Int16()
+			message := d.Text()
+			if err = kafkaCheck(code); err != nil && message != "" {
+				log.Printf("ERR %s: %s", addr, message)
+			}
+		}
+	}
+	if err != nil {
+		c.Close()
+		log.Printf("ERR logging in to %s: %s", addr, err)
+		if e, ok := err.(kafkaError); ok && (e.Unauthorized() || e == 33) {
+			return nil, k.authFailed(addr)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// check turns a kafka error into the error the session should end with.
+func (k *Kafka) check(what string, addr string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(kafkaError); ok {
+		switch {
+		case e == 22 || e == 27:
+			return errKafkaRejoin
+		case e == 25:
+			k.member = ""
+			return errKafkaRejoin
+		case e.Unauthorized():
+			log.Printf("ERR %s on %s: %s", what, addr, err)
+			return k.authFailed(addr)
+		}
+	}
+	log.Printf("ERR %s on %s: %s", what, addr, err)
+	return err
+}
+
+// metadata asks which brokers lead the topics' partitions.
+func (s *kafkaSession) metadata(topics []string) (kafkaCluster, error) {
+	var request kafkaEncoder
+	request.Array(len(topics))
+	for _, topic := range topics {
+		request.Text(topic)
+	}
+	request.Int8(0)
+
+	d, err := s.bootstrap.Call(kafkaMetadata, request.buf, 30*time.Second)
+	if err != nil {
+		return kafkaCluster{}, err
+	}
+
+	cluster := kafkaCluster{
+		Brokers:    make(map[int32]string),
+		Partitions: make(map[string][]int32),
+		Leaders:    make(map[kafkaPartition]int32),
+	}
+	d.Int32()
+	for i := d.Array(); i > 0; i-- {
+		node := d.Int32()
+		host := d.Text()
+		port := d.Int32()
+		d.Text()
+		cluster.Brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.Text()
+	d.Int32()
+
+	for i := d.Array(); i > 0; i-- {
+		code := d.Int16()
+		topic := d.Text()
+		d.Int8()
+		for j := d.Array(); j > 0; j-- {
+			d.Int16()
+			partition := d.Int32()
+			leader := d.Int32()
+			for n := d.Array(); n > 0; n-- {
+				d.Int32()
+			}
+			for n := d.Array(); n > 0; n-- {
+				d.Int32()
+			}
+			cluster.Partitions[topic] = append(cluster.Partitions[topic], partition)
+			cluster.Leaders[kafkaPartition{topic, partition}] = leader
+		}
+		if d.err == nil && code != 0 {
+			return cluster, fmt.Errorf("topic %s: %s", topic, kafkaError(code))
+		}
+		sort.Slice(cluster.Partitions[topic], func(a, b int) bool {
+			return cluster.Partitions[topic][a] < cluster.Partitions[topic][b]
+		})
+	}
+	return cluster, d.err
+}
+
+// findCoordinator connects to the broker that looks after the group.
+func (s *kafkaSession) findCoordinator() (*kafkaConn, error) {
+	var request kafkaEncoder
+	request.Text(s.Group)
+	request.Int8(0)
+
+	d, err := s.bootstrap.Call(kafkaFindCoordinator, request.buf, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	d.Int32()
+	code := d.Int16()
+	d.Text()
+	d.Int32()
+	host := d.Text()
+	port := d.Int32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := kafkaCheck(code); err != nil {
+		return nil, s.check("finding the coordinator for "+s.Group, s.bootstrap.Addr, err)
+	}
+	return s.dial(net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+// join joins the group and learns which partitions are ours. The leader
+// shares each topic's partitions out between the members subscribed to it
+// in ranges, as Kafka's own consumers do.
+func (s *kafkaSession) join() error {
+	var subscription kafkaEncoder
+	subscription.Int16(0)
+	subscription.Array(len(s.Topics))
+	for _, topic := range s.Topics {
+		subscription.Text(topic)
+	}
+	subscription.Bytes(nil)
+
+	var request kafkaEncoder
+	request.Text(s.Group)
+	request.Int32(int32(kafkaSessionTimeout / time.Millisecond))
+	request.Int32(int32(kafkaRebalanceTimeout / time.Millisecond))
+	request.Text(s.member)
+	request.Text("consumer")
+	request.Array(1)
+	request.Text("range")
+	request.Bytes(subscription.buf)
+
+	addr := s.coordinator.Addr
+	d, err := s.coordinator.Call(kafkaJoinGroup, request.buf, kafkaRebalanceTimeout+30*time.Second)
+	if err != nil {
+		return err
+	}
+	d.Int32()
+	code := d.Int16()
+	generation := d.Int32()
+	d.Text()
+	leader := d.Text()
+	member := d.Text()
+	subscriptions := make(map[string][]string)
+	for i := d.Array(); i > 0; i-- {
+		id := d.Text()
+		metadata := &kafkaDecoder{buf: d.Bytes()}
+		metadata.Int16()
+		for j := metadata.Array(); j > 0; j-- {
+			subscriptions[id] = append(subscriptions[id], metadata.Text())
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if err := kafkaCheck(code); err != nil {
+		return s.check("joining "+s.Group, addr, err)
+	}
+	s.member = member
+	s.generation = generation
+
+	var assignments map[string][]kafkaPartition
+	if member == leader {
+		var topics []string
+		for _, subscribed := range subscriptions {
+			for _, topic := range subscribed {
+				if !containsString(topics, topic) {
+					topics = append(topics, topic)
+				}
+			}
+		}
+		cluster, err := s.metadata(topics)
+		if err != nil {
+			log.Printf("ERR reading metadata from %s: %s", s.bootstrap.Addr, err)
+			return err
+		}
+		assignments = kafkaRangeAssign(subscriptions, cluster.Partitions)
+	}
+
+	request = kafkaEncoder{}
+	request.Text(s.Group)
+	request.Int32(s.generation)
+	request.Text(s.member)
+	request.Array(len(assignments))
+	for id, partitions := range assignments {
+		request.Text(id)
+		request.Bytes(kafkaAssignment(partitions))
+	}
+
+	d, err = s.coordinator.Call(kafkaSyncGroup, request.buf, kafkaRebalanceTimeout+30*time.Second)
+	if err != nil {
+		return err
+	}
+	d.Int32()
+	code = d.Int16()
+	assignment := &kafkaDecoder{buf: d.Bytes()}
+	if d.err != nil {
+		return d.err
+	}
+	if err := kafkaCheck(code); err != nil {
+		return s.check("syncing "+s.Group, addr, err)
+	}
+
+	s.assigned = nil
+	if len(assignment.buf) > 0 {
+		assignment.Int16()
+		for i := assignment.Array(); i > 0; i-- {
+			topic := assignment.Text()
+			for j := assignment.Array(); j > 0; j-- {
+				s.assigned = append(s.assigned, kafkaPartition{topic, assignment.Int32()})
+			}
+		}
+		if assignment.err != nil {
+			return fmt.Errorf("bad assignment from %s: %s", addr, assignment.err)
+		}
+	}
+	return nil
+}
+
+// kafkaRangeAssign gives each member a run of each topic's partitions.
+func kafkaRangeAssign(subscriptions map[string][]string, partitions map[string][]int32) map[string][]kafkaPartition {
+	assignments := make(map[string][]kafkaPartition)
+	members := make(map[string][]string)
+	for id, topics := range subscriptions {
+		assignments[id] = nil
+		for _, topic := range topics {
+			members[topic] = append(members[topic], id)
+		}
+	}
+
+	for topic, ids := range members {
+		sort.Strings(ids)
+		each, extra := len(partitions[topic])/len(ids), len(partitions[topic])%len(ids)
+		next := 0
+		for i, id := range ids {
+			n := each
+			if i < extra {
+				n++
+			}
+			for _, partition := range partitions[topic][next : next+n] {
+				assignments[id] = append(assignments[id], kafkaPartition{topic, partition})
+			}
+			next += n
+		}
+	}
+	return assignments
+}
+
+// kafkaAssignment encodes the partitions given to a member.
+func kafkaAssignment(partitions []kafkaPartition) []byte {
+	topics := make(map[string][]int32)
+	var order []string
+	for _, p := range partitions {
+		if _, ok := topics[p.Topic]; !ok {
+			order = append(order, p.Topic)
+		}
+		topics[p.Topic] = append(topics[p.Topic], p.Partition)
+	}
+
+	var e kafkaEncoder
+	e.Int16(0)
+	e.Array(len(order))
+	for _, topic := range order {
+		e.Text(topic)
+		e.Array(len(topics[topic]))
+		for _, partition := range topics[topic] {
+			e.Int32(partition)
+		}
+	}
+	e.Bytes(nil)
+	return e.buf
+}
+
+// byTopic groups partitions under their topics, in the order given.
+func byTopic(partitions []kafkaPartition) ([]string, map[string][]int32) {
+	grouped := make(map[string][]int32)
+	var topics []string
+	for _, p := range partitions {
+		if _, ok := grouped[p.Topic]; !ok {
+			topics = append(topics, p.Topic)
+		}
+		grouped[p.Topic] = append(grouped[p.Topic], p.Partition)
+	}
+	return topics, grouped
+}
+
+// leader returns a connection to the broker leading a partition.
+func (s *kafkaSession) leader(p kafkaPartition) (*kafkaConn, error) {
+	node, ok := s.cluster.Leaders[p]
+	if !ok || node < 0 {
+		return nil, fmt.Errorf("%s/%d has no leader", p.Topic, p.Partition)
+	}
+	if c, ok := s.leaders[node]; ok {
+		return c, nil
+	}
+	c, err := s.dial(s.cluster.Brokers[node])
+	if err != nil {
+		return nil, err
+	}
+	s.leaders[node] = c
+	return c, nil
+}
+
+// fetchOffsets finds where to start on each of our partitions: where the
+// group left off, or the start or end of the partition if it never read
+// it.
+func (s *kafkaSession) fetchOffsets() error {
+	topics, partitions := byTopic(s.assigned)
+
+	var request kafkaEncoder
+	request.Text(s.Group)
+	request.Array(len(topics))
+	for _, topic := range topics {
+		request.Text(topic)
+		request.Array(len(partitions[topic]))
+		for _, partition := range partitions[topic] {
+			request.Int32(partition)
+		}
+	}
+
+	d, err := s.coordinator.Call(kafkaOffsetFetch, request.buf, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	var unread []kafkaPartition
+	for i := d.Array(); i > 0; i-- {
+		topic := d.Text()
+		for j := d.Array(); j > 0; j-- {
+			p := kafkaPartition{topic, d.Int32()}
+			offset := d.Int64()
+			d.Text()
+			if err := kafkaCheck(d.Int16()); err != nil && d.err == nil {
+				return s.check(fmt.Sprintf("fetching offsets for %s/%d", p.Topic, p.Partition), s.coordinator.Addr, err)
+			}
+			if offset < 0 {
+				unread = append(unread, p)
+				continue
+			}
+			s.positions[p] = offset
+			s.committed[p] = offset
+		}
+	}
+	if err := kafkaCheck(d.Int16()); err != nil && d.err == nil {
+		return s.check("fetching offsets for "+s.Group, s.coordinator.Addr, err)
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	return s.resetOffsets(unread)
+}
+
+// resetOffsets moves partitions to their start or end, as configured.
+func (s *kafkaSession) resetOffsets(reset []kafkaPartition) error {
+	timestamp := int64(-1)
+	if s.Start == "earliest" {
+		timestamp = -2
+	}
+
+	for _, p := range reset {
+		c, err := s.leader(p)
+		if err != nil {
+			return err
+		}
+
+		var request kafkaEncoder
+		request.Int32(-1)
+		request.Array(1)
+		request.Text(p.Topic)
+		request.Array(1)
+		request.Int32(p.Partition)
+		request.Int64(timestamp)
+
+		d, err := c.Call(kafkaListOffsets, request.buf, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		d.Array()
+		d.Text()
+		d.Array()
+		d.Int32()
+		code := d.Int16()
+		d.Int64()
+		offset := d.Int64()
+		if d.err != nil {
+			return d.err
+		}
+		if err := kafkaCheck(code); err != nil {
+			return s.check(fmt.Sprintf("listing offsets for %s/%d", p.Topic, p.Partition), c.Addr, err)
+		}
+		s.positions[p] = offset
+	}
+	return nil
+}
+
+// commit tells the group how far we've got with a partition.
+func (s *kafkaSession) commit(p kafkaPartition) error {
+	offset := s.positions[p]
+	if committed, ok := s.committed[p]; ok && committed == offset {
+		return nil
+	}
+
+	var request kafkaEncoder
+	request.Text(s.Group)
+	request.Int32(s.generation)
+	request.Text(s.member)
+	request.Int64(-1)
+	request.Array(1)
+	request.Text(p.Topic)
+	request.Array(1)
+	request.Int32(p.Partition)
+	request.Int64(offset)
+	request.Text("")
+
+	d, err := s.coordinator.Call(kafkaOffsetCommit, request.buf, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	d.Array()
+	d.Text()
+	d.Array()
+	d.Int32()
+	code := d.Int16()
+	if d.err != nil {
+		return d.err
+	}
+	if err := kafkaCheck(code); err != nil {
+		return s.check(fmt.Sprintf("committing %s/%d", p.Topic, p.Partition), s.coordinator.Addr, err)
+	}
+	s.committed[p] = offset
+	return nil
+}
+
+// heartbeat keeps our place in the group, and tells us when it's
+// rebalancing.
+func (s *kafkaSession) heartbeat() error {
+	var request kafkaEncoder
+	request.Text(s.Group)
+	request.Int32(s.generation)
+	request.Text(s.member)
+
+	d, err := s.coordinator.Call(kafkaHeartbeat, request.buf, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	d.Int32()
+	code := d.Int16()
+	if d.err != nil {
+		return d.err
+	}
+	return s.check("heartbeat for "+s.Group, s.coordinator.Addr, kafkaCheck(code))
+}
+
+// fetch reads what's new on the partitions a broker leads, singing the
+// records and committing as it goes.
+func (s *kafkaSession) fetch(c *kafkaConn, partitions []kafkaPartition, conductor chan *choir.Note) error {
+	topics, grouped := byTopic(partitions)
+
+	var request kafkaEncoder
+	request.Int32(-1)
+	request.Int32(int32(kafkaFetchWait / time.Millisecond))
+	request.Int32(1)
+	request.Int32(kafkaFetchBytes)
+	request.Int8(0)
+	request.Array(len(topics))
+	for _, topic := range topics {
+		request.Text(topic)
+		request.Array(len(grouped[topic]))
+		for _, partition := range grouped[topic] {
+			request.Int32(partition)
+			request.Int64(s.positions[kafkaPartition{topic, partition}])
+			request.Int32(kafkaFetchBytes)
+		}
+	}
+
+	d, err := c.Call(kafkaFetch, request.buf, kafkaFetchWait+30*time.Second)
+	if err != nil {
+		return err
+	}
+	d.Int32()
+
+	type fetched struct {
+		kafkaPartition
+		data []byte
+	}
+	var results []fetched
+	var reset []kafkaPartition
+	moved := false
+	for i := d.Array(); i > 0; i-- {
+		topic := d.Text()
+		for j := d.Array(); j > 0; j-- {
+			p := kafkaPartition{topic, d.Int32()}
+			code := d.Int16()
+			d.Int64()
+			d.Int64()
+			for n := d.Array(); n > 0; n-- {
+				d.Int64()
+				d.Int64()
+			}
+			data := d.Bytes()
+			if d.err != nil {
+				break
+			}
+
+			switch code {
+			case 0:
+				results = append(results, fetched{p, data})
+			case 1:
+				log.Printf("ERR offset %d is gone from %s/%d, starting from the %s", s.positions[p], p.Topic, p.Partition, s.Start)
+				reset = append(reset, p)
+			case 5, 6:
+				// Another broker leads it now, the others can still be read
+				moved = true
+			default:
+				return s.check(fmt.Sprintf("fetching %s/%d", p.Topic, p.Partition), c.Addr, kafkaError(code))
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if err := s.resetOffsets(reset); err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		records, next, err := kafkaRecords(result.data)
+		if err != nil {
+			// It won't read any better next time, so leave it be
+			log.Printf("ERR reading %s/%d at offset %d: %s", result.Topic, result.Partition, s.positions[result.kafkaPartition], err)
+			s.stuck[result.kafkaPartition] = true
+			s.Health.Report(fmt.Sprintf("is stuck on %s/%d at offset %d: %s", result.Topic, result.Partition, s.positions[result.kafkaPartition], err), conductor)
+		}
+
+		for _, record := range records {
+			if record.Offset < s.positions[result.kafkaPartition] {
+				continue
+			}
+			s.positions[result.kafkaPartition] = record.Offset + 1
+
+			if note := s.Deliver(result.Topic, result.Partition, record); note != nil {
+				conductor <- note
+
+				// Only committed once the conductor has it
+				if err := s.commit(result.kafkaPartition); err != nil {
+					return err
+				}
+			}
+		}
+		if next > s.positions[result.kafkaPartition] {
+			s.positions[result.kafkaPartition] = next
+		}
+		if err := s.commit(result.kafkaPartition); err != nil {
+			return err
+		}
+	}
+	if moved {
+		return errKafkaMoved
+	}
+	return nil
+}
+
+// refresh reads the metadata again after a leader has moved, dropping
+// connections to brokers that may no longer lead anything of ours.
+func (s *kafkaSession) refresh() error {
+	time.Sleep(kafkaMovedWait)
+	cluster, err := s.metadata(s.Topics)
+	if err != nil {
+		log.Printf("ERR reading metadata from %s: %s", s.bootstrap.Addr, err)
+		return err
+	}
+	s.cluster = cluster
+	for node, c := range s.leaders {
+		c.Close()
+		delete(s.leaders, node)
+	}
+	return nil
+}
+
+// consume fetches from our partitions' leaders until the group rebalances
+// or something goes wrong, keeping up the heartbeat in between.
+func (s *kafkaSession) consume(conductor chan *choir.Note) error {
+	heartbeat := time.Now()
+	for {
+		if time.Since(heartbeat) >= kafkaHeartbeatEvery {
+			if err := s.heartbeat(); err != nil {
+				return err
+			}
+			heartbeat = time.Now()
+		}
+
+		byLeader := make(map[int32][]kafkaPartition)
+		var nodes []int32
+		for _, p := range s.assigned {
+			if s.stuck[p] {
+				continue
+			}
+			node := s.cluster.Leaders[p]
+			if _, ok := byLeader[node]; !ok {
+				nodes = append(nodes, node)
+			}
+			byLeader[node] = append(byLeader[node], p)
+		}
+
+		// Nothing to read, but we're still a member
+		if len(nodes) == 0 {
+			time.Sleep(kafkaHeartbeatEvery)
+			continue
+		}
+
+		for _, node := range nodes {
+			c, err := s.leader(byLeader[node][0])
+			if err != nil {
+				return err
+			}
+			err = s.fetch(c, byLeader[node], conductor)
+			if err == errKafkaMoved {
+				if err := s.refresh(); err != nil {
+					return err
+				}
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Deliver makes a note of a record, if the rules want it and it's the one
+// in N that its topic's sampling sings.
+func (k *Kafka) Deliver(topic string, partition int32, record kafkaRecord) *choir.Note {
+	headers := make(map[string]interface{})
+	for key, value := range record.Headers {
+		headers[key] = value
+	}
+
+	data := make(map[string]interface{})
+	addPayload(data, "value", record.Value)
+	data["payload"] = data["value"]
+
+	// The record's own fields, which its value can't replace
+	data["topic"] = topic
+	data["partition"] = partition
+	data["offset"] = record.Offset
+	data["key"] = string(record.Key)
+	data["headers"] = headers
+	data["timestamp"] = record.Timestamp
+
+	note := k.Hear(data, nil)
+	if note == nil {
+		return nil
+	}
+	if every := k.Sample[topic]; every > 1 {
+		k.sampled[topic]++
+		if k.sampled[topic]%every != 1 {
+			return nil
+		}
+	}
+	return note
+}
+
+// Session connects to the cluster and consumes as a member of the group
+// until something goes wrong, joining again whenever it rebalances.
+func (k *Kafka) Session(conductor chan *choir.Note) error {
+	s := &kafkaSession{Kafka: k, leaders: make(map[int32]*kafkaConn)}
+	defer func() {
+		for _, c := range []*kafkaConn{s.bootstrap, s.coordinator} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		for _, c := range s.leaders {
+			c.Close()
+		}
+	}()
+
+	// Any broker will do to start with, unless it's our login that's wrong
+	var err error
+	for _, broker := range k.Brokers {
+		if s.bootstrap, err = k.dial(broker); err == nil {
+			break
+		}
+		if _, ok := err.(*StatusError); ok {
+			return err
+		}
+	}
+	if s.bootstrap == nil {
+		return err
+	}
+	if s.coordinator, err = s.findCoordinator(); err != nil {
+		return err
+	}
+
+	for {
+		err := s.join()
+		if err == nil {
+			if s.cluster, err = s.metadata(k.Topics); err != nil {
+				log.Printf("ERR reading metadata from %s: %s", s.bootstrap.Addr, err)
+				return err
+			}
+			s.positions = make(map[kafkaPartition]int64)
+			s.committed = make(map[kafkaPartition]int64)
+			s.stuck = make(map[kafkaPartition]bool)
+			err = s.fetchOffsets()
+		}
+		if err == nil {
+			k.Health.Observe(nil, 0, conductor)
+			err = s.consume(conductor)
+		}
+		if err != errKafkaRejoin {
+			return err
+		}
+	}
+}
+
+func (k *Kafka) Run(conductor chan *choir.Note) {
+	if k.Notes == nil || len(k.Brokers) == 0 {
+		return
+	}
+
+	for {
+		err := k.Session(conductor)
+		time.Sleep(k.Health.Observe(err, 5*time.Second, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered Kafka")
+	RegisterFactory("kafka", func() Servicer { return &Kafka{} })
+}
@@ -0,0 +1,273 @@
+package ensemble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Kafka API keys. We speak one version of each, old enough for any broker
+// since 0.11 and new enough for 4.0, and none of them use the flexible
+// encoding.
+const (
+	kafkaFetch            = 1
+	kafkaListOffsets      = 2
+	kafkaMetadata         = 3
+	kafkaOffsetCommit     = 8
+	kafkaOffsetFetch      = 9
+	kafkaFindCoordinator  = 10
+	kafkaJoinGroup        = 11
+	kafkaHeartbeat        = 12
+	kafkaSyncGroup        = 14
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+)
+
+var kafkaVersions = map[int16]int16{
+	kafkaFetch:            4,
+	kafkaListOffsets:      1,
+	kafkaMetadata:         4,
+	kafkaOffsetCommit:     2,
+	kafkaOffsetFetch:      2,
+	kafkaFindCoordinator:  1,
+	kafkaJoinGroup:        2,
+	kafkaHeartbeat:        1,
+	kafkaSyncGroup:        1,
+	kafkaSaslHandshake:    1,
+	kafkaSaslAuthenticate: 0,
+}
+
+// Biggest response we'll read, a full fetch plus room to spare
+const kafkaMaxResponse = 64 << 20
+
+var errKafkaShort = errors.New("kafka response ended early")
+
+// kafkaError is an error code from a broker.
+type kafkaError int16
+
+var kafkaErrorNames = map[kafkaError]string{
+	1:  "offset out of range",
+	3:  "unknown topic or partition",
+	6:  "not leader for partition",
+	14: "coordinator loading",
+	15: "coordinator not available",
+	16: "not coordinator",
+	22: "illegal generation",
+	25: "unknown member id",
+	27: "rebalance in progress",
+	29: "topic authorization failed",
+	30: "group authorization failed",
+	31: "cluster authorization failed",
+	33: "unsupported SASL mechanism",
+	35: "unsupported version",
+	58: "SASL authentication failed",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return fmt.Sprintf("kafka error %d, %s", int16(e), name)
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+// Unauthorized is true when our credentials or ACLs are wrong.
+func (e kafkaError) Unauthorized() bool {
+	return e == 29 || e == 30 || e == 31 || e == 58
+}
+
+// kafkaCheck turns an error code into an error, or nil.
+func kafkaCheck(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return kafkaError(code)
+}
+
+// kafkaEncoder writes a request body.
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) Int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *kafkaEncoder) Int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) Int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) Int64(v int64) {
+	e.Int32(int32(v >> 32))
+	e.Int32(int32(v))
+}
+
+func (e *kafkaEncoder) Text(s string) {
+	e.Int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// Bytes writes b with its length, nil as null.
+func (e *kafkaEncoder) Bytes(b []byte) {
+	if b == nil {
+		e.Int32(-1)
+		return
+	}
+	e.Int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// Array writes the length of an array, whose items follow.
+func (e *kafkaEncoder) Array(n int) {
+	e.Int32(int32(n))
+}
+
+// kafkaDecoder reads a response. Reading past the end leaves it empty, with
+// an error to check once at the end.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = errKafkaShort
+		d.buf = nil
+
+		// Zeroes, so the numbers read after an error needn't check
+		if n >= 0 && n <= 8 {
+			return make([]byte, n)
+		}
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) Int8() int8 {
+	return int8(d.take(1)[0])
+}
+
+func (d *kafkaDecoder) Int16() int16 {
+	return int16(binary.BigEndian.Uint16(d.take(2)))
+}
+
+func (d *kafkaDecoder) Int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.take(4)))
+}
+
+func (d *kafkaDecoder) Int64() int64 {
+	return int64(binary.BigEndian.Uint64(d.take(8)))
+}
+
+// Text reads a string, null as "".
+func (d *kafkaDecoder) Text() string {
+	n := int(d.Int16())
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(n))
+}
+
+// Bytes reads bytes with a length, null as nil.
+func (d *kafkaDecoder) Bytes() []byte {
+	n := int(d.Int32())
+	if n < 0 {
+		return nil
+	}
+	return d.take(n)
+}
+
+// Array reads the length of an array, null as empty.
+func (d *kafkaDecoder) Array() int {
+	n := int(d.Int32())
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	return n
+}
+
+// Varint reads a zigzag varint, as used inside record batches.
+func (d *kafkaDecoder) Varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errKafkaShort
+		d.buf = nil
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// VarBytes reads bytes with a varint length, -1 as nil.
+func (d *kafkaDecoder) VarBytes() []byte {
+	n := int(d.Varint())
+	if n < 0 {
+		return nil
+	}
+	return d.take(n)
+}
+
+// kafkaConn is a connection to one broker. Requests are made one at a time.
+type kafkaConn struct {
+	Addr string
+
+	conn        net.Conn
+	reader      *bufio.Reader
+	correlation int32
+}
+
+func (c *kafkaConn) Close() {
+	c.conn.Close()
+}
+
+// Call sends a request and returns a decoder for the response body, waiting
+// at most wait for it.
+func (c *kafkaConn) Call(api int16, body []byte, wait time.Duration) (*kafkaDecoder, error) {
+	c.correlation++
+
+	var request kafkaEncoder
+	request.Int32(0)
+	request.Int16(api)
+	request.Int16(kafkaVersions[api])
+	request.Int32(c.correlation)
+	request.Text("choirmaster")
+	request.buf = append(request.buf, body...)
+	binary.BigEndian.PutUint32(request.buf, uint32(len(request.buf)-4))
+
+	c.conn.SetDeadline(time.Now().Add(wait))
+	if _, err := c.conn.Write(request.buf); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length > kafkaMaxResponse {
+		return nil, fmt.Errorf("%s sent a %d byte response", c.Addr, length)
+	}
+
+	response := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{buf: response}
+	if correlation := d.Int32(); correlation != c.correlation {
+		return nil, fmt.Errorf("%s answered request %d with %d", c.Addr, c.correlation, correlation)
+	}
+	return d, nil
+}
@@ -0,0 +1,350 @@
+package ensemble
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Record batch compression codecs
+const (
+	kafkaNone   = 0
+	kafkaGzip   = 1
+	kafkaSnappy = 2
+	kafkaLz4    = 3
+	kafkaZstd   = 4
+)
+
+// Where things are in a record batch's header, which is followed by its
+// records
+const (
+	kafkaBatchMagic      = 16
+	kafkaBatchAttributes = 21
+	kafkaBatchLastDelta  = 23
+	kafkaBatchTimestamp  = 27
+	kafkaBatchCount      = 57
+	kafkaBatchRecords    = 61
+)
+
+// Java's snappy framing, which Kafka producers use
+var xerialMagic = []byte("\x82SNAPPY\x00")
+
+type kafkaRecord struct {
+	Offset    int64
+	Timestamp time.Time
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// kafkaRecords reads the record batches fetched for a partition. next is
+// the offset after the last whole batch, which moves on even when a batch
+// has nothing for us, like the markers transactions leave behind. A batch
+// cut short by the fetch size is left for the next fetch.
+func kafkaRecords(data []byte) (records []kafkaRecord, next int64, err error) {
+	next = -1
+	for len(data) >= kafkaBatchRecords {
+		base := int64(binary.BigEndian.Uint64(data))
+		size := int(binary.BigEndian.Uint32(data[8:])) + 12
+		if size < kafkaBatchRecords || len(data) < size {
+			break
+		}
+		batch := data[:size]
+		data = data[size:]
+
+		if magic := batch[kafkaBatchMagic]; magic != 2 {
+			return records, next, fmt.Errorf("kafka message format v%d isn't supported", magic)
+		}
+		attributes := binary.BigEndian.Uint16(batch[kafkaBatchAttributes:])
+		lastDelta := int64(binary.BigEndian.Uint32(batch[kafkaBatchLastDelta:]))
+		timestamp := int64(binary.BigEndian.Uint64(batch[kafkaBatchTimestamp:]))
+		count := int(binary.BigEndian.Uint32(batch[kafkaBatchCount:]))
+
+		// Control batches mark the end of a transaction
+		if attributes&0x20 != 0 {
+			next = base + lastDelta + 1
+			continue
+		}
+
+		body, err := kafkaDecompress(int(attributes&0x07), batch[kafkaBatchRecords:])
+		if err != nil {
+			return records, next, err
+		}
+
+		d := &kafkaDecoder{buf: body}
+		for i := 0; i < count && d.err == nil; i++ {
+			record := &kafkaDecoder{buf: d.take(int(d.Varint()))}
+			record.Int8()
+			timestampDelta := record.Varint()
+			offsetDelta := record.Varint()
+			r := kafkaRecord{
+				Offset:    base + offsetDelta,
+				Timestamp: time.Unix(0, (timestamp+timestampDelta)*int64(time.Millisecond)),
+				Key:       record.VarBytes(),
+				Value:     record.VarBytes(),
+				Headers:   make(map[string]string),
+			}
+			for h := record.Varint(); h > 0 && record.err == nil; h-- {
+				key := record.VarBytes()
+				r.Headers[string(key)] = string(record.VarBytes())
+			}
+			if record.err != nil {
+				d.err = record.err
+				break
+			}
+			records = append(records, r)
+		}
+		if d.err != nil {
+			return records, next, fmt.Errorf("bad kafka record batch at offset %d: %s", base, d.err)
+		}
+
+		next = base + lastDelta + 1
+	}
+
+	return records, next, nil
+}
+
+func kafkaDecompress(codec int, data []byte) ([]byte, error) {
+	switch codec {
+	case kafkaNone:
+		return data, nil
+	case kafkaGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(io.LimitReader(r, kafkaMaxResponse))
+	case kafkaSnappy:
+		return xerialDecode(data)
+	case kafkaLz4:
+		return lz4FrameDecode(data)
+	case kafkaZstd:
+		return nil, errors.New("zstd compressed kafka batches aren't supported")
+	}
+	return nil, fmt.Errorf("unknown kafka compression codec %d", codec)
+}
+
+// xerialDecode reads snappy data, either in Java's xerial framing, a header
+// then length prefixed blocks, or as a single block.
+func xerialDecode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, xerialMagic) {
+		return snappyDecode(data)
+	}
+
+	// Magic, then two version numbers
+	if len(data) < len(xerialMagic)+8 {
+		return nil, errors.New("snappy header cut short")
+	}
+	data = data[len(xerialMagic)+8:]
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("snappy block length cut short")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if len(data) < 4+size {
+			return nil, errors.New("snappy block cut short")
+		}
+		block, err := snappyDecode(data[4 : 4+size])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, block...)
+		data = data[4+size:]
+	}
+	return out, nil
+}
+
+// snappyDecode reads a snappy block: its length, then literals and copies
+// of what came before.
+func snappyDecode(data []byte) ([]byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > kafkaMaxResponse {
+		return nil, errors.New("bad snappy block length")
+	}
+	data = data[n:]
+	out := make([]byte, 0, length)
+
+	for len(data) > 0 {
+		tag := data[0]
+		var size, offset int
+
+		switch tag & 0x03 {
+		case 0:
+			size = int(tag>>2) + 1
+			data = data[1:]
+			if size > 60 {
+				extra := size - 60
+				if len(data) < extra {
+					return nil, errors.New("snappy literal cut short")
+				}
+				size = 1
+				for i := extra - 1; i >= 0; i-- {
+					size += int(data[i]) << (8 * uint(i))
+				}
+				data = data[extra:]
+			}
+			if len(data) < size {
+				return nil, errors.New("snappy literal cut short")
+			}
+			out = append(out, data[:size]...)
+			data = data[size:]
+			continue
+		case 1:
+			if len(data) < 2 {
+				return nil, errors.New("snappy copy cut short")
+			}
+			size = int(tag>>2&0x07) + 4
+			offset = int(tag&0xe0)<<3 | int(data[1])
+			data = data[2:]
+		case 2:
+			if len(data) < 3 {
+				return nil, errors.New("snappy copy cut short")
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(data[1:]))
+			data = data[3:]
+		case 3:
+			if len(data) < 5 {
+				return nil, errors.New("snappy copy cut short")
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(data[1:]))
+			data = data[5:]
+		}
+
+		if offset <= 0 || offset > len(out) {
+			return nil, errors.New("bad snappy copy offset")
+		}
+		// Copies can overlap what they're writing, so go a byte at a time
+		start := len(out) - offset
+		for i := 0; i < size; i++ {
+			out = append(out, out[start+i])
+		}
+	}
+
+	if uint64(len(out)) != length {
+		return nil, errors.New("snappy block has the wrong length")
+	}
+	return out, nil
+}
+
+// lz4FrameDecode reads an LZ4 frame: a header, blocks that are compressed
+// or not, and an end mark. Checksums are skipped, the batch has its own.
+func lz4FrameDecode(data []byte) ([]byte, error) {
+	if len(data) < 7 || binary.LittleEndian.Uint32(data) != 0x184d2204 {
+		return nil, errors.New("bad lz4 frame")
+	}
+	flags := data[4]
+	header := 7
+	if flags&0x08 != 0 {
+		header += 8
+	}
+	if flags&0x01 != 0 {
+		header += 4
+	}
+	if len(data) < header {
+		return nil, errors.New("lz4 frame header cut short")
+	}
+	data = data[header:]
+
+	var out []byte
+	for {
+		if len(data) < 4 {
+			return nil, errors.New("lz4 block length cut short")
+		}
+		size := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if size == 0 {
+			return out, nil
+		}
+
+		compressed := size&0x80000000 == 0
+		size &= 0x7fffffff
+		if uint32(len(data)) < size {
+			return nil, errors.New("lz4 block cut short")
+		}
+
+		var err error
+		if compressed {
+			// Blocks may refer back to earlier ones, so decode onto out
+			if out, err = lz4BlockDecode(out, data[:size]); err != nil {
+				return nil, err
+			}
+		} else {
+			out = append(out, data[:size]...)
+		}
+		if len(out) > kafkaMaxResponse {
+			return nil, errors.New("lz4 frame too big")
+		}
+
+		data = data[size:]
+		if flags&0x10 != 0 {
+			if len(data) < 4 {
+				return nil, errors.New("lz4 block checksum cut short")
+			}
+			data = data[4:]
+		}
+	}
+}
+
+// lz4BlockDecode appends a block of literals and matches to out.
+func lz4BlockDecode(out, block []byte) ([]byte, error) {
+	// Lengths of 15 go on in the following bytes
+	length := func(n int) (int, bool) {
+		if n != 15 {
+			return n, true
+		}
+		for len(block) > 0 {
+			b := block[0]
+			block = block[1:]
+			n += int(b)
+			if b != 255 {
+				return n, true
+			}
+		}
+		return n, false
+	}
+
+	for len(block) > 0 {
+		token := block[0]
+		block = block[1:]
+
+		literals, ok := length(int(token >> 4))
+		if !ok || len(block) < literals {
+			return nil, errors.New("lz4 literals cut short")
+		}
+		out = append(out, block[:literals]...)
+		block = block[literals:]
+
+		// The last sequence is only literals
+		if len(block) == 0 {
+			break
+		}
+
+		if len(block) < 2 {
+			return nil, errors.New("lz4 match cut short")
+		}
+		offset := int(binary.LittleEndian.Uint16(block))
+		block = block[2:]
+		match, ok := length(int(token & 0x0f))
+		if !ok {
+			return nil, errors.New("lz4 match cut short")
+		}
+		match += 4
+
+		if offset == 0 || offset > len(out) {
+			return nil, errors.New("bad lz4 match offset")
+		}
+		start := len(out) - offset
+		for i := 0; i < match; i++ {
+			out = append(out, out[start+i])
+		}
+	}
+
+	return out, nil
+}
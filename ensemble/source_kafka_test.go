@@ -0,0 +1,208 @@
+package ensemble
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Record batches of the same two records at offsets 40 and 41, as a
+// producer sends them with each codec
+var kafkaBatches = []struct {
+	name string
+	hex  string
+}{
+	{"uncompressed",
+		"0000000000000028000000df000000000221f7b6350000000000010000018bcfe568000000018bcfe56800ffffffffff" +
+			"ffffffffffffffffff00000002ac01000000046b3088017b22617070223a22617069222c226e223a302c22706164223a" +
+			"2261626162616261626162616261626162616261626162616261626162616261626162616261626162227d0206656e76" +
+			"0870726f64a8010014020188017b22617070223a22617069222c226e223a312c22706164223a22616261626162616261" +
+			"62616261626162616261626162616261626162616261626162616261626162227d0206656e760870726f64"},
+	{"gzip",
+		"0000000000000028000000840000000002fbbec4430001000000010000018bcfe568000000018bcfe56800ffffffffff" +
+			"ffffffffffffffffff000000021f8b08000000000000ff5ac3c8c0c0c0926dd0c158ad945850a064a5945890a9a4a394" +
+			"a76465a0a3549098021249220e2ad532b1a5e695711414e5a7ac6064106162c462aa2125a6020600e710463cae000000"},
+	{"snappy block",
+		"0000000000000028000000790000000002071343000002000000010000018bcfe568000000018bcfe56800ffffffffff" +
+			"ffffffffffffffffff00000002ae0180ac01000000046b3088017b22617070223a22617069222c226e223a302c227061" +
+			"64011200629602004c227d0206656e760870726f64a8010014020188014256000031ee5600"},
+	{"snappy xerial",
+		"0000000000000028000000c60000000002606f12e30002000000010000018bcfe568000000018bcfe56800ffffffffff" +
+			"ffffffffffffffffff0000000282534e415050590000000001000000010000002a4080ac01000000046b3088017b2261" +
+			"7070223a22617069222c226e223a302c22706164011200626602000000003b400461621902cc227d0206656e76087072" +
+			"6f64a8010014020188017b22617070223a22617069222c226e223a312c22706164223a22616261626162000000142e04" +
+			"61627e02002c227d0206656e760870726f64"},
+	{"lz4 frame",
+		"0000000000000028000000900000000002bb6fcea80003000000010000018bcfe568000000018bcfe56800ffffffffff" +
+			"ffffffffffffffffff0000000204224d186440a74c000000f012ac01000000046b3088017b22617070223a2261706922" +
+			"2c226e223a302c2270616412001f62020013ff03227d0206656e760870726f64a801001402015600001f315600245008" +
+			"70726f64000000001b81ba14"},
+}
+
+// A transaction marker at offset 42
+var kafkaControlBatch = "000000000000002a00000031000000000289866c930020000000000000018bcfe568000000018bcfe56800ffffffffff" +
+	"ffffffffffffffffff00000001"
+
+func kafkaBatch(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestKafkaRecords(t *testing.T) {
+	stamp := time.Unix(1700000000, 0)
+	pad := strings.Repeat("ab", 20)
+
+	for _, tt := range kafkaBatches {
+		batch := kafkaBatch(t, tt.hex)
+		control := kafkaBatch(t, kafkaControlBatch)
+
+		// A batch cut short by the fetch size waits for the next fetch
+		data := append(append(append([]byte{}, batch...), control...), batch[:len(batch)-5]...)
+		records, next, err := kafkaRecords(data)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if next != 43 {
+			t.Errorf("%s: next = %d, want 43", tt.name, next)
+		}
+		if len(records) != 2 {
+			t.Errorf("%s: %d records, want 2", tt.name, len(records))
+			continue
+		}
+
+		for i, r := range records {
+			value := fmt.Sprintf(`{"app":"api","n":%d,"pad":"%s"}`, i, pad)
+			if r.Offset != int64(40+i) || string(r.Value) != value || r.Headers["env"] != "prod" {
+				t.Errorf("%s: record %d = %d %q %v", tt.name, i, r.Offset, r.Value, r.Headers)
+			}
+			if want := stamp.Add(time.Duration(i*10) * time.Millisecond); !r.Timestamp.Equal(want) {
+				t.Errorf("%s: record %d timestamp = %s, want %s", tt.name, i, r.Timestamp, want)
+			}
+		}
+		if string(records[0].Key) != "k0" || records[1].Key != nil {
+			t.Errorf("%s: keys = %q %q, want \"k0\" and none", tt.name, records[0].Key, records[1].Key)
+		}
+	}
+
+	if records, next, err := kafkaRecords(nil); len(records) != 0 || next != -1 || err != nil {
+		t.Errorf("kafkaRecords(nil) = %d records, %d, %v", len(records), next, err)
+	}
+}
+
+func TestKafkaRecordsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(batch []byte)
+	}{
+		{"old message format", func(batch []byte) { batch[kafkaBatchMagic] = 1 }},
+		{"zstd", func(batch []byte) { batch[kafkaBatchAttributes+1] = kafkaZstd }},
+		{"unknown codec", func(batch []byte) { batch[kafkaBatchAttributes+1] = 6 }},
+		{"corrupt gzip", func(batch []byte) { batch[kafkaBatchAttributes+1] = kafkaGzip }},
+		{"corrupt snappy", func(batch []byte) { batch[kafkaBatchAttributes+1] = kafkaSnappy }},
+		{"corrupt lz4", func(batch []byte) { batch[kafkaBatchAttributes+1] = kafkaLz4 }},
+		{"short record", func(batch []byte) { batch[kafkaBatchRecords] = 0x7e }},
+		{"negative record length", func(batch []byte) { batch[kafkaBatchRecords] = 0x01 }},
+	}
+	for _, tt := range tests {
+		batch := kafkaBatch(t, kafkaBatches[0].hex)
+		tt.change(batch)
+		if _, _, err := kafkaRecords(batch); err == nil {
+			t.Errorf("%s: kafkaRecords should fail", tt.name)
+		}
+	}
+
+	// Snappy with the xerial magic but no room for its version numbers
+	batch := kafkaBatch(t, kafkaBatches[0].hex)[:kafkaBatchRecords]
+	batch[kafkaBatchAttributes+1] = kafkaSnappy
+	batch = append(batch, xerialMagic...)
+	batch = append(batch, 0, 0, 0, 1)
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	if _, _, err := kafkaRecords(batch); err == nil {
+		t.Error("short xerial header: kafkaRecords should fail")
+	}
+}
+
+func TestKafkaRangeAssign(t *testing.T) {
+	partitions := map[string][]int32{
+		"orders":  {0, 1, 2, 3, 4},
+		"refunds": {0, 1},
+	}
+	tests := []struct {
+		subscriptions map[string][]string
+		want          map[string][]kafkaPartition
+	}{
+		{
+			map[string][]string{"a": {"orders"}},
+			map[string][]kafkaPartition{"a": {{"orders", 0}, {"orders", 1}, {"orders", 2}, {"orders", 3}, {"orders", 4}}},
+		},
+		{
+			map[string][]string{"b": {"orders"}, "a": {"orders"}},
+			map[string][]kafkaPartition{
+				"a": {{"orders", 0}, {"orders", 1}, {"orders", 2}},
+				"b": {{"orders", 3}, {"orders", 4}},
+			},
+		},
+		{
+			map[string][]string{"a": {"refunds"}, "b": {"refunds"}, "c": {"refunds"}},
+			map[string][]kafkaPartition{"a": {{"refunds", 0}}, "b": {{"refunds", 1}}, "c": nil},
+		},
+		{
+			map[string][]string{"a": {"orders", "refunds"}, "b": {"refunds"}},
+			map[string][]kafkaPartition{
+				"a": {{"orders", 0}, {"orders", 1}, {"orders", 2}, {"orders", 3}, {"orders", 4}, {"refunds", 0}},
+				"b": {{"refunds", 1}},
+			},
+		},
+		{
+			map[string][]string{"a": {"missing"}},
+			map[string][]kafkaPartition{"a": nil},
+		},
+	}
+	for _, tt := range tests {
+		got := kafkaRangeAssign(tt.subscriptions, partitions)
+		for _, assigned := range got {
+			sort.Slice(assigned, func(i, j int) bool {
+				if assigned[i].Topic != assigned[j].Topic {
+					return assigned[i].Topic < assigned[j].Topic
+				}
+				return assigned[i].Partition < assigned[j].Partition
+			})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("kafkaRangeAssign(%v) = %v, want %v", tt.subscriptions, got, tt.want)
+		}
+	}
+}
+
+func TestKafkaDeliver(t *testing.T) {
+	k := &Kafka{}
+	k.Configure(map[string]interface{}{
+		"brokers": []string{"localhost"},
+		"topics":  []string{"orders"},
+		"label":   "{{.topic}}/{{.partition}}:{{.key}}",
+		"text":    "{{.app}} at {{.offset}} in {{.headers.env}}",
+	})
+
+	record := kafkaRecord{
+		Offset:  40,
+		Key:     []byte("k0"),
+		Value:   []byte(`{"app":"api","key":"spoofed","topic":"spoofed","partition":9,"offset":9,"headers":"spoofed"}`),
+		Headers: map[string]string{"env": "prod"},
+	}
+	note := k.Deliver("orders", 3, record)
+	if note == nil {
+		t.Fatal("Deliver made no note")
+	}
+	if note.Label != "orders/3:k0" || note.Text != "api at 40 in prod" {
+		t.Errorf("note = %q %q, want %q %q", note.Label, note.Text, "orders/3:k0", "api at 40 in prod")
+	}
+}
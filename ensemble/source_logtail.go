@@ -0,0 +1,344 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const logtailDefaultInterval = 1 * time.Second
+
+// Longest line we'll wait for the end of before giving up on it
+const logtailMaxLine = 64 << 10
+
+// Most we read from a file at once, so a big backlog is worked through a
+// poll at a time rather than all held in memory
+const logtailMaxRead = 8 << 20
+
+var logtailDefaultTemplate = NoteTemplate{
+	Label: "Log:{{.file}}",
+	Sound: "n/0",
+	Text:  "{{.line}}",
+}
+
+// Logtail follows log files and sings about lines that match its rules.
+type Logtail struct {
+	Name     string
+	Files    []*TailedFile
+	Rules    []*LogRule
+	Interval time.Duration
+	Choir    *choir.Choir
+}
+
+type LogtailConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Name     string
+	Files    []string
+	Interval int
+	Rules    []LogRuleConfig
+}
+
+type LogRuleConfig struct {
+	Match string
+	NoteTemplate
+}
+
+// LogRule turns lines matching its expression into notes. Named groups in
+// the expression are available to the templates.
+type LogRule struct {
+	Match *regexp.Regexp
+	Notes *NoteMaker
+}
+
+// TailedFile is a log file we're following and how far we've read.
+type TailedFile struct {
+	Path    string
+	File    *os.File
+	Id      uint64
+	Offset  int64
+	Partial []byte
+}
+
+// LogCheckpoint is saved between restarts so we carry on where we were.
+type LogCheckpoint struct {
+	Id     uint64
+	Offset int64
+}
+
+func (lt *Logtail) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject LogtailConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if len(configObject.Files) == 0 || len(configObject.Rules) == 0 {
+		log.Printf("ERR logtail source needs files and rules")
+		return
+	}
+
+	for _, rc := range configObject.Rules {
+		match, err := regexp.Compile(rc.Match)
+		if err != nil {
+			log.Printf("ERR bad logtail rule %q: %s", rc.Match, err)
+			return
+		}
+		notes, err := rc.NoteTemplate.Compile(logtailDefaultTemplate)
+		if err != nil {
+			log.Printf("ERR bad logtail rule %q: %s", rc.Match, err)
+			return
+		}
+		lt.Rules = append(lt.Rules, &LogRule{Match: match, Notes: notes})
+	}
+
+	for _, path := range configObject.Files {
+		lt.Files = append(lt.Files, &TailedFile{Path: path})
+	}
+
+	lt.Name = configObject.Name
+	if lt.Name == "" {
+		lt.Name = filepath.Base(configObject.Files[0])
+	}
+	lt.Interval = time.Duration(configObject.Interval) * time.Second
+	if lt.Interval <= 0 {
+		lt.Interval = logtailDefaultInterval
+	}
+	lt.Choir = choir.NewChoir(configObject.Key)
+	lt.Choir.Format = notetext.ParseFormat(configObject.Format)
+
+	fmt.Printf("Configured logtail: %s\n", lt.Name)
+}
+
+func (tf *TailedFile) checkpointKey() string {
+	return "logtail:" + tf.Path
+}
+
+// Open starts following the file. We carry on from the checkpoint if it's
+// for the same file, or else start from the end: what's already in the log
+// has already happened.
+func (tf *TailedFile) Open() error {
+	file, err := os.Open(tf.Path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	tf.File = file
+	tf.Id = fileId(info)
+	tf.Offset = info.Size()
+	tf.Partial = nil
+
+	var saved LogCheckpoint
+	if Checkpoints.Load(tf.checkpointKey(), &saved) {
+		switch {
+		case saved.Id == tf.Id && saved.Offset <= info.Size():
+			tf.Offset = saved.Offset
+		case saved.Id == tf.Id:
+			log.Printf("%s was truncated while we were away, reading from the start", tf.Path)
+			tf.Offset = 0
+		default:
+			// Rotated while we were away, the whole file is new
+			tf.Offset = 0
+		}
+	}
+
+	_, err = file.Seek(tf.Offset, io.SeekStart)
+	return err
+}
+
+// reopen switches to a new file at the same path after rotation, reading it
+// from the start.
+func (tf *TailedFile) reopen() error {
+	tf.File.Close()
+	tf.File = nil
+
+	file, err := os.Open(tf.Path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	log.Printf("%s was rotated, following the new file", tf.Path)
+	tf.File = file
+	tf.Id = fileId(info)
+	tf.Offset = 0
+	tf.Partial = nil
+	return nil
+}
+
+// ReadLines returns the complete lines written since the last read. It
+// notices the file being rotated or truncated.
+func (tf *TailedFile) ReadLines() ([]string, error) {
+	if tf.File == nil {
+		if err := tf.Open(); err != nil {
+			return nil, err
+		}
+	}
+
+	read := tf.Offset
+	lines, err := tf.readToEnd()
+	if err != nil {
+		return lines, err
+	}
+
+	// There's more to come, rotation can wait until we've read it
+	if tf.Offset-read >= logtailMaxRead {
+		return lines, nil
+	}
+
+	current, err := os.Stat(tf.Path)
+	if err != nil {
+		// Mid rotation, the new file will turn up
+		return lines, nil
+	}
+
+	opened, err := tf.File.Stat()
+	if err != nil {
+		return lines, err
+	}
+
+	switch {
+	case !os.SameFile(opened, current):
+		// We've read all of the old file, carry on with the new one
+		if err := tf.reopen(); err != nil {
+			return lines, err
+		}
+		more, err := tf.readToEnd()
+		return append(lines, more...), err
+	case current.Size() < tf.Offset:
+		log.Printf("%s was truncated, reading from the start", tf.Path)
+		tf.Offset = 0
+		tf.Partial = nil
+		if _, err := tf.File.Seek(0, io.SeekStart); err != nil {
+			return lines, err
+		}
+		more, err := tf.readToEnd()
+		return append(lines, more...), err
+	}
+
+	return lines, nil
+}
+
+// readToEnd reads the lines written since the last read, or as many as fit
+// in logtailMaxRead.
+func (tf *TailedFile) readToEnd() ([]string, error) {
+	data, err := io.ReadAll(io.LimitReader(tf.File, logtailMaxRead))
+	if err != nil {
+		return nil, err
+	}
+	tf.Offset += int64(len(data))
+
+	data = append(tf.Partial, data...)
+	lines := make([]string, 0)
+
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		lines = append(lines, string(bytes.TrimRight(data[:end], "\r")))
+		data = data[end+1:]
+	}
+
+	// Keep the start of a line that's still being written
+	tf.Partial = append([]byte(nil), data...)
+	if len(tf.Partial) > logtailMaxLine {
+		lines = append(lines, string(tf.Partial))
+		tf.Partial = nil
+	}
+
+	return lines, nil
+}
+
+// Checkpoint saves how far through the file we've read, not counting a
+// partial line.
+func (tf *TailedFile) Checkpoint() {
+	if tf.File == nil {
+		return
+	}
+	Checkpoints.Save(tf.checkpointKey(), LogCheckpoint{
+		Id:     tf.Id,
+		Offset: tf.Offset - int64(len(tf.Partial)),
+	})
+}
+
+// BuildNote runs the line through the rules in order, the first match wins.
+func (lt *Logtail) BuildNote(tf *TailedFile, line string) *choir.Note {
+	for _, rule := range lt.Rules {
+		found := rule.Match.FindStringSubmatch(line)
+		if found == nil {
+			continue
+		}
+
+		data := map[string]interface{}{
+			"line": line,
+			"file": filepath.Base(tf.Path),
+			"path": tf.Path,
+		}
+		for i, name := range rule.Match.SubexpNames() {
+			if name != "" {
+				data[name] = found[i]
+			}
+		}
+
+		note, err := rule.Notes.Make(lt.Choir, data)
+		if err != nil {
+			log.Printf("ERR making note for %s: %s", lt.Name, err)
+			return nil
+		}
+		return note
+	}
+	return nil
+}
+
+func (lt *Logtail) Run(conductor chan *choir.Note) {
+	if len(lt.Rules) == 0 {
+		return
+	}
+
+	for {
+		for _, tf := range lt.Files {
+			lines, err := tf.ReadLines()
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("ERR reading %s: %s", tf.Path, err)
+			}
+
+			for _, line := range lines {
+				if note := lt.BuildNote(tf, line); note != nil {
+					conductor <- note
+				}
+			}
+
+			if len(lines) > 0 {
+				tf.Checkpoint()
+			}
+		}
+
+		time.Sleep(lt.Interval)
+	}
+}
+
+func init() {
+	fmt.Println("Registered Logtail")
+	RegisterFactory("logtail", func() Servicer { return &Logtail{} })
+}
@@ -0,0 +1,318 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// How long the homeserver holds a /sync open waiting for something to happen
+const matrixSyncTimeout = 30 * time.Second
+
+// Most events a room sends us per sync, so a long absence doesn't flood
+const matrixTimelineLimit = 50
+
+// Matrix follows rooms on a Matrix homeserver with the client-server /sync
+// long poll. The sync token is checkpointed, so after a restart we pick up
+// what was said while we were away.
+type Matrix struct {
+	Name       string
+	Homeserver string
+	Token      string
+	Rooms      []string
+	Quiet      bool
+	Client     *http.Client
+	Choir      *choir.Choir
+	Health     SourceHealth
+	Activity   *ChatActivity
+
+	// Room ids of the configured Rooms, which can be aliases
+	RoomIds []string
+	Since   string
+
+	RoomNames *NameCache
+	UserNames *NameCache
+}
+
+type MatrixConfig struct {
+	Type         string
+	Key          string
+	Format       string
+	Name         string
+	Homeserver   string
+	Access_Token string
+	Rooms        []string
+	Quiet        bool
+	Activity     int
+}
+
+type MatrixSync struct {
+	Next_Batch string
+	Rooms      struct {
+		Join map[string]MatrixRoom
+	}
+}
+
+type MatrixRoom struct {
+	State struct {
+		Events []MatrixEvent
+	}
+	Timeline struct {
+		Events []MatrixEvent
+	}
+}
+
+type MatrixEvent struct {
+	Type      string
+	Sender    string
+	State_Key string
+	Content   struct {
+		Msgtype     string
+		Body        string
+		Name        string
+		Displayname string
+		Relates_To  struct {
+			Rel_Type string
+		} `json:"m.relates_to"`
+	}
+}
+
+func (m *Matrix) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject MatrixConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Homeserver == "" || configObject.Access_Token == "" {
+		log.Printf("ERR matrix source needs a homeserver and access_token")
+		return
+	}
+
+	m.Homeserver = strings.TrimSuffix(configObject.Homeserver, "/")
+	m.Token = configObject.Access_Token
+	m.Rooms = configObject.Rooms
+	m.Quiet = configObject.Quiet
+	m.Client = &http.Client{Timeout: matrixSyncTimeout + 30*time.Second}
+
+	m.Name = configObject.Name
+	if m.Name == "" {
+		if u, err := url.Parse(m.Homeserver); err == nil {
+			m.Name = u.Host
+		}
+	}
+
+	m.Choir = choir.NewChoir(configObject.Key)
+	m.Choir.Format = notetext.ParseFormat(configObject.Format)
+	m.Health = SourceHealth{Name: m.Name, Choir: m.Choir}
+	if configObject.Activity > 0 {
+		m.Activity = NewChatActivity("Matrix", time.Duration(configObject.Activity)*time.Second, m.Choir)
+	}
+
+	m.RoomNames = NewNameCache(deskNameTTL)
+	m.UserNames = NewNameCache(deskNameTTL)
+
+	fmt.Printf("Configured Matrix: %s\n", m.Name)
+}
+
+func (m *Matrix) checkpointKey() string {
+	return "matrix:" + m.Name
+}
+
+// get calls the client-server API and decodes the answer into v.
+func (m *Matrix) get(path string, query url.Values, v interface{}) error {
+	apiUrl := m.Homeserver + "/_matrix/client/v3" + path
+	if len(query) > 0 {
+		apiUrl += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", apiUrl, nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.Token)
+
+	return FetchJSON(m.Name, m.Client, req, v)
+}
+
+// GetRoom returns the room's name, or its alias if it has no name.
+func (m *Matrix) GetRoom(id string) string {
+	name, _ := m.RoomNames.Get(id, func() (string, error) {
+		// Rooms needn't have either, which the homeserver answers with a 404
+		var named struct{ Name string }
+		var aliased struct{ Alias string }
+		m.get("/rooms/"+url.PathEscape(id)+"/state/m.room.name", nil, &named)
+		if named.Name == "" {
+			m.get("/rooms/"+url.PathEscape(id)+"/state/m.room.canonical_alias", nil, &aliased)
+		}
+		return pickString(named.Name, pickString(aliased.Alias, id)), nil
+	})
+	return name
+}
+
+// GetUser returns the user's display name, or the local part of their id.
+func (m *Matrix) GetUser(id string) string {
+	name, _ := m.UserNames.Get(id, func() (string, error) {
+		var profile struct{ Displayname string }
+		m.get("/profile/"+url.PathEscape(id)+"/displayname", nil, &profile)
+
+		local := strings.TrimPrefix(strings.SplitN(id, ":", 2)[0], "@")
+		return pickString(profile.Displayname, local), nil
+	})
+	return name
+}
+
+// ResolveRooms looks up the room ids of configured aliases. Ones it can't
+// find are left out until the next try.
+func (m *Matrix) ResolveRooms() {
+	m.RoomIds = nil
+	for _, room := range m.Rooms {
+		if !strings.HasPrefix(room, "#") {
+			m.RoomIds = append(m.RoomIds, room)
+			continue
+		}
+
+		var found struct{ Room_Id string }
+		if err := m.get("/directory/room/"+url.PathEscape(room), nil, &found); err != nil || found.Room_Id == "" {
+			log.Printf("ERR matrix couldn't find room %s, will try again", room)
+			continue
+		}
+		m.RoomIds = append(m.RoomIds, found.Room_Id)
+		m.RoomNames.Set(found.Room_Id, room)
+	}
+}
+
+// syncFilter asks only for what we sing about, from the rooms we follow.
+func (m *Matrix) syncFilter() string {
+	room := map[string]interface{}{
+		"timeline":  map[string]interface{}{"types": []string{"m.room.message", "m.room.name", "m.room.member"}, "limit": matrixTimelineLimit},
+		"state":     map[string]interface{}{"types": []string{"m.room.name", "m.room.member"}, "lazy_load_members": true},
+		"ephemeral": map[string]interface{}{"not_types": []string{"*"}},
+	}
+	if len(m.Rooms) > 0 {
+		room["rooms"] = m.RoomIds
+	}
+
+	filter, _ := json.Marshal(map[string]interface{}{
+		"room":         room,
+		"presence":     map[string]interface{}{"not_types": []string{"*"}},
+		"account_data": map[string]interface{}{"not_types": []string{"*"}},
+	})
+	return string(filter)
+}
+
+// Learn remembers room and display names from state events.
+func (m *Matrix) Learn(roomId string, events []MatrixEvent) {
+	for _, e := range events {
+		switch {
+		case e.Type == "m.room.name" && e.Content.Name != "":
+			m.RoomNames.Set(roomId, e.Content.Name)
+		case e.Type == "m.room.member" && e.Content.Displayname != "":
+			m.UserNames.Set(e.State_Key, e.Content.Displayname)
+		}
+	}
+}
+
+// Hear returns a note for a message, or nil for anything else. Bots'
+// notices and edits are skipped.
+func (m *Matrix) Hear(roomId string, e MatrixEvent) *choir.Note {
+	if e.Type != "m.room.message" || e.Content.Body == "" {
+		return nil
+	}
+	if e.Content.Msgtype == "m.notice" || e.Content.Relates_To.Rel_Type == "m.replace" {
+		return nil
+	}
+
+	room, speaker := m.GetRoom(roomId), m.GetUser(e.Sender)
+	if m.Activity != nil {
+		m.Activity.Count(room, speaker)
+	}
+	if m.Quiet {
+		return nil
+	}
+
+	return chatNote("Matrix", room, speaker, e.Content.Body, e.Content.Msgtype == "m.emote", m.Choir)
+}
+
+// Sync waits for the next batch of events and sings it. The first sync
+// without a checkpoint only learns names, rather than replaying history.
+func (m *Matrix) Sync(conductor chan *choir.Note) error {
+	query := url.Values{
+		"timeout": {fmt.Sprintf("%d", matrixSyncTimeout/time.Millisecond)},
+		"filter":  {m.syncFilter()},
+	}
+	if m.Since != "" {
+		query.Set("since", m.Since)
+	}
+
+	var batch MatrixSync
+	if err := m.get("/sync", query, &batch); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(batch.Rooms.Join))
+	for id := range batch.Rooms.Join {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		room := batch.Rooms.Join[id]
+		m.Learn(id, room.State.Events)
+		m.Learn(id, room.Timeline.Events)
+
+		if m.Since == "" || (len(m.Rooms) > 0 && !containsString(m.RoomIds, id)) {
+			continue
+		}
+		for _, e := range room.Timeline.Events {
+			if note := m.Hear(id, e); note != nil {
+				conductor <- note
+			}
+		}
+	}
+
+	m.Since = batch.Next_Batch
+	Checkpoints.Save(m.checkpointKey(), m.Since)
+	return nil
+}
+
+func (m *Matrix) Run(conductor chan *choir.Note) {
+	if m.Homeserver == "" {
+		return
+	}
+
+	Checkpoints.Load(m.checkpointKey(), &m.Since)
+	if m.Activity != nil {
+		go m.Activity.Sing(conductor)
+	}
+
+	for {
+		// Until every room is found, or a homeserver that was down at the
+		// start would leave them out for good
+		if len(m.RoomIds) < len(m.Rooms) {
+			m.ResolveRooms()
+		}
+
+		err := m.Sync(conductor)
+
+		// A sync that succeeds has already waited for something to happen
+		if wait := m.Health.Observe(err, time.Second, conductor); err != nil {
+			time.Sleep(wait)
+		}
+	}
+}
+
+func init() {
+	fmt.Println("Registered Matrix")
+	RegisterFactory("matrix", func() Servicer { return &Matrix{} })
+}
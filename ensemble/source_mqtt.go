@@ -0,0 +1,352 @@
+package ensemble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect   = 1
+	mqttConnack   = 2
+	mqttPublish   = 3
+	mqttPuback    = 4
+	mqttSubscribe = 8
+	mqttSuback    = 9
+	mqttPingreq   = 12
+)
+
+const mqttDefaultKeepalive = 60 * time.Second
+
+// MQTT subscribes to topic filters on an MQTT broker and sings the messages
+// published to them.
+type MQTT struct {
+	Bus
+
+	Server    BusServer
+	ClientId  string
+	Username  string
+	Password  string
+	Topics    []string
+	Qos       byte
+	Retained  bool
+	Keepalive time.Duration
+}
+
+type MQTTConfig struct {
+	Type      string
+	Broker    string
+	Client_Id string
+	Username  string
+	Password  string
+	Topics    []string
+	Qos       int
+	Retained  bool
+	Keepalive int
+
+	BusConfig
+}
+
+type mqttPacket struct {
+	Kind  byte
+	Flags byte
+	Body  []byte
+}
+
+// mqttConn writes packets from both the reader and the keepalive pinger.
+type mqttConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (c *mqttConn) Write(kind, flags byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The remaining length is a base-128 varint
+	header := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		header = append(header, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := c.conn.Write(append(header, body...))
+	return err
+}
+
+func readMqttPacket(r *bufio.Reader) (p mqttPacket, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	p.Kind, p.Flags = first>>4, first&0x0f
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return p, err
+		}
+		if i == 4 {
+			return p, errors.New("mqtt remaining length too long")
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxResponseBytes {
+		return p, fmt.Errorf("mqtt packet of %d bytes is too big", length)
+	}
+
+	p.Body = make([]byte, length)
+	_, err = io.ReadFull(r, p.Body)
+	return
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func (m *MQTT) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject MQTTConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Broker == "" || len(configObject.Topics) == 0 {
+		log.Printf("ERR mqtt source needs a broker and topics")
+		return
+	}
+	server, err := ParseBusServer(configObject.Broker, []string{"ssl", "tls", "mqtts"}, "1883", "8883")
+	if err != nil {
+		log.Printf("ERR mqtt source has a bad broker: %s", err)
+		return
+	}
+	if !m.configureBus("mqtt", configObject.BusConfig, server.Address) {
+		return
+	}
+
+	m.Server = server
+	m.Username = configObject.Username
+	m.Password = configObject.Password
+	if server.User != nil {
+		m.Username = server.User.Username()
+		m.Password, _ = server.User.Password()
+	}
+	m.Topics = configObject.Topics
+	m.Retained = configObject.Retained
+
+	m.ClientId = configObject.Client_Id
+
+	// QoS 2 is delivered as 1, which is just as good to us
+	if configObject.Qos > 0 {
+		m.Qos = 1
+	}
+	m.Keepalive = time.Duration(configObject.Keepalive) * time.Second
+	if m.Keepalive <= 0 {
+		m.Keepalive = mqttDefaultKeepalive
+	}
+
+	fmt.Printf("Configured MQTT: %s %s\n", m.Name, strings.Join(m.Topics, ","))
+}
+
+// connectPacket asks for a persistent session when we have a client id of
+// our own, so QoS 1 messages wait for us while we're away.
+func (m *MQTT) connectPacket() []byte {
+	flags := byte(0)
+	if m.ClientId == "" {
+		flags |= 0x02
+	}
+	if m.Username != "" {
+		flags |= 0x80
+		if m.Password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(m.Keepalive/time.Second))
+	body = append(body, mqttString(m.ClientId)...)
+	if m.Username != "" {
+		body = append(body, mqttString(m.Username)...)
+		if m.Password != "" {
+			body = append(body, mqttString(m.Password)...)
+		}
+	}
+	return body
+}
+
+// Message turns a PUBLISH into its topic, payload and the packet id to
+// acknowledge, if it needs one.
+func (m *MQTT) Message(p mqttPacket) (topic string, payload []byte, id []byte, err error) {
+	body := p.Body
+	if len(body) < 2 {
+		return "", nil, nil, errors.New("mqtt publish too short")
+	}
+	length := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+length {
+		return "", nil, nil, errors.New("mqtt publish topic too long")
+	}
+	topic, body = string(body[2:2+length]), body[2+length:]
+
+	if (p.Flags>>1)&0x03 > 0 {
+		if len(body) < 2 {
+			return "", nil, nil, errors.New("mqtt publish without a packet id")
+		}
+		id, body = body[:2], body[2:]
+	}
+	return topic, body, id, nil
+}
+
+// Session connects, subscribes and listens until the connection drops,
+// returning why it did.
+func (m *MQTT) Session(conductor chan *choir.Note) error {
+	conn, err := m.Server.Dial()
+	if err != nil {
+		log.Printf("ERR connecting to %s: %s", m.Server.Address, err)
+		return err
+	}
+	defer conn.Close()
+
+	c := &mqttConn{conn: conn}
+	reader := bufio.NewReader(conn)
+	read := func() (mqttPacket, error) {
+		// The broker answers our pings, so silence means it's gone
+		conn.SetReadDeadline(time.Now().Add(m.Keepalive * 3 / 2))
+		return readMqttPacket(reader)
+	}
+
+	if err := c.Write(mqttConnect, 0, m.connectPacket()); err != nil {
+		return err
+	}
+	ack, err := read()
+	if err != nil {
+		log.Printf("ERR connecting to %s: %s", m.Server.Address, err)
+		return err
+	}
+	if ack.Kind != mqttConnack || len(ack.Body) < 2 {
+		return fmt.Errorf("%s didn't accept our connection", m.Server.Address)
+	}
+	switch ack.Body[1] {
+	case 0:
+	case 4, 5:
+		log.Printf("ERR %s refused our credentials", m.Server.Address)
+		return m.authFailed(m.Server.Address)
+	default:
+		log.Printf("ERR %s refused our connection (%d)", m.Server.Address, ack.Body[1])
+		return fmt.Errorf("%s refused our connection (%d)", m.Server.Address, ack.Body[1])
+	}
+
+	subscribe := []byte{0, 1}
+	for _, topic := range m.Topics {
+		subscribe = append(append(subscribe, mqttString(topic)...), m.Qos)
+	}
+	if err := c.Write(mqttSubscribe, 0x02, subscribe); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(m.Keepalive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.Write(mqttPingreq, 0, nil)
+			}
+		}
+	}()
+
+	for {
+		p, err := read()
+		if err != nil {
+			log.Printf("ERR reading from %s: %s", m.Server.Address, err)
+			return err
+		}
+
+		switch p.Kind {
+		case mqttSuback:
+			m.Health.Observe(nil, 0, conductor)
+			if len(p.Body) < 2 {
+				continue
+			}
+			for i, code := range p.Body[2:] {
+				if code == 0x80 && i < len(m.Topics) {
+					log.Printf("ERR %s refused our subscription to %s", m.Server.Address, m.Topics[i])
+				}
+			}
+		case mqttPublish:
+			topic, payload, id, err := m.Message(p)
+			if err != nil {
+				log.Printf("ERR reading from %s: %s", m.Server.Address, err)
+				return err
+			}
+
+			// Retained messages are old news, the last thing said before
+			// we subscribed
+			retained := p.Flags&0x01 == 1
+			if !retained || m.Retained {
+				data := map[string]interface{}{
+					"topic":    topic,
+					"levels":   strings.Split(topic, "/"),
+					"retained": retained,
+				}
+				if note := m.Hear(data, payload); note != nil {
+					conductor <- note
+				}
+			}
+
+			// Only acknowledged once it's been sung
+			if id != nil {
+				if err := c.Write(mqttPuback, 0, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (m *MQTT) Run(conductor chan *choir.Note) {
+	if m.Notes == nil || m.Server.Address == "" {
+		return
+	}
+
+	for {
+		err := m.Session(conductor)
+		time.Sleep(m.Health.Observe(err, 5*time.Second, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered MQTT")
+	RegisterFactory("mqtt", func() Servicer { return &MQTT{} })
+}
@@ -0,0 +1,187 @@
+package ensemble
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+func TestMqttPacket(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte
+	}{
+		{0, []byte{0x30, 0x00}},
+		{1, []byte{0x30, 0x01}},
+		{127, []byte{0x30, 0x7f}},
+		{128, []byte{0x30, 0x80, 0x01}},
+		{16383, []byte{0x30, 0xff, 0x7f}},
+		{16384, []byte{0x30, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		body := bytes.Repeat([]byte("x"), tt.size)
+		go (&mqttConn{conn: client}).Write(mqttPublish, 0, body)
+
+		raw := make([]byte, len(tt.header)+tt.size)
+		if _, err := io.ReadFull(server, raw); err != nil {
+			t.Fatalf("reading a packet of %d bytes: %s", tt.size, err)
+		}
+		client.Close()
+		server.Close()
+
+		if !bytes.Equal(raw[:len(tt.header)], tt.header) {
+			t.Errorf("header for %d bytes = % x, want % x", tt.size, raw[:len(tt.header)], tt.header)
+		}
+		p, err := readMqttPacket(bufio.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			t.Errorf("readMqttPacket of %d bytes: %s", tt.size, err)
+		} else if p.Kind != mqttPublish || p.Flags != 0 || !bytes.Equal(p.Body, body) {
+			t.Errorf("readMqttPacket of %d bytes = kind %d flags %d, %d bytes", tt.size, p.Kind, p.Flags, len(p.Body))
+		}
+	}
+
+	for _, raw := range []string{"", "\x30", "\x30\xff\xff\xff\xff\x01", "\x30\x05ab"} {
+		if _, err := readMqttPacket(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("readMqttPacket(%q) should fail", raw)
+		}
+	}
+}
+
+func TestMqttMessage(t *testing.T) {
+	var m MQTT
+	tests := []struct {
+		flags   byte
+		body    string
+		topic   string
+		payload string
+		id      string
+	}{
+		{0x00, "\x00\x03a/bhi", "a/b", "hi", ""},
+		{0x01, "\x00\x03a/b", "a/b", "", ""},
+		{0x02, "\x00\x03a/b\x00\x07hi", "a/b", "hi", "\x00\x07"},
+		{0x04, "\x00\x01a\x01\x00", "a", "", "\x01\x00"},
+	}
+	for _, tt := range tests {
+		topic, payload, id, err := m.Message(mqttPacket{Kind: mqttPublish, Flags: tt.flags, Body: []byte(tt.body)})
+		if err != nil {
+			t.Errorf("Message(%q): %s", tt.body, err)
+		} else if topic != tt.topic || string(payload) != tt.payload || string(id) != tt.id {
+			t.Errorf("Message(%q) = %q %q %q, want %q %q %q", tt.body, topic, payload, id, tt.topic, tt.payload, tt.id)
+		}
+	}
+
+	bad := []struct {
+		flags byte
+		body  string
+	}{
+		{0x00, ""},
+		{0x00, "\x00"},
+		{0x00, "\x00\x05a/b"},
+		{0x02, "\x00\x03a/b\x00"},
+	}
+	for _, tt := range bad {
+		if _, _, _, err := m.Message(mqttPacket{Kind: mqttPublish, Flags: tt.flags, Body: []byte(tt.body)}); err == nil {
+			t.Errorf("Message(%q) should fail", tt.body)
+		}
+	}
+}
+
+func TestMqttConnectPacket(t *testing.T) {
+	tests := []struct {
+		m    MQTT
+		want string
+	}{
+		{MQTT{Keepalive: time.Minute}, "\x00\x04MQTT\x04\x02\x00\x3c\x00\x00"},
+		{MQTT{ClientId: "cm", Keepalive: 30 * time.Second}, "\x00\x04MQTT\x04\x00\x00\x1e\x00\x02cm"},
+		{MQTT{Username: "u", Keepalive: time.Minute}, "\x00\x04MQTT\x04\x82\x00\x3c\x00\x00\x00\x01u"},
+		{MQTT{Username: "u", Password: "p", Keepalive: time.Minute}, "\x00\x04MQTT\x04\xc2\x00\x3c\x00\x00\x00\x01u\x00\x01p"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.m.connectPacket()); got != tt.want {
+			t.Errorf("connectPacket(%+v) = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestMqttSession(t *testing.T) {
+	acked := make(chan string, 1)
+	address := fakeBroker(t, func(conn net.Conn) {
+		c := &mqttConn{conn: conn}
+		reader := bufio.NewReader(conn)
+
+		if p, err := readMqttPacket(reader); err != nil || p.Kind != mqttConnect {
+			t.Errorf("broker wanted CONNECT, got %+v %v", p, err)
+			return
+		}
+		c.Write(mqttConnack, 0, []byte{0, 0})
+
+		p, err := readMqttPacket(reader)
+		if err != nil || p.Kind != mqttSubscribe || !bytes.Contains(p.Body, mqttString("deploys/#")) {
+			t.Errorf("broker wanted SUBSCRIBE to deploys/#, got %+v %v", p, err)
+			return
+		}
+		c.Write(mqttSuback, 0, []byte{0, 1, 1})
+
+		// A retained message, which is skipped, then one at QoS 1
+		c.Write(mqttPublish, 0x01, append(mqttString("deploys/old"), `{"app":"old"}`...))
+		c.Write(mqttPublish, 0x02, append(append(mqttString("deploys/api"), 0, 9), `{"app":"api","user":"alice"}`...))
+
+		for {
+			p, err := readMqttPacket(reader)
+			if err != nil {
+				return
+			}
+			if p.Kind == mqttPuback {
+				acked <- string(p.Body)
+				return
+			}
+		}
+	})
+
+	m := &MQTT{}
+	m.Configure(map[string]interface{}{
+		"broker": "tcp://" + address,
+		"topics": []string{"deploys/#"},
+		"qos":    1,
+		"name":   "mqtt-test",
+		"label":  "Deploy:{{index .levels 1}}",
+		"text":   "{{.user}} deployed {{.app}}",
+	})
+
+	conductor := make(chan *choir.Note, 10)
+	done := make(chan error, 1)
+	go func() { done <- m.Session(conductor) }()
+
+	note := waitForNote(t, conductor)
+	if note.Label != "Deploy:api" || note.Text != "alice deployed api" {
+		t.Errorf("note = %q %q, want %q %q", note.Label, note.Text, "Deploy:api", "alice deployed api")
+	}
+
+	select {
+	case id := <-acked:
+		if id != "\x00\x09" {
+			t.Errorf("PUBACK for %q, want %q", id, "\x00\x09")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the message was never acknowledged")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Session ended without an error when the broker hung up")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Session didn't notice the broker hanging up")
+	}
+	if len(conductor) > 0 {
+		t.Errorf("the retained message was sung: %+v", <-conductor)
+	}
+}
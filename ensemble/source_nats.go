@@ -0,0 +1,425 @@
+package ensemble
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+// Servers ping every two minutes, so a connection this quiet is dead
+const natsReadTimeout = 5 * time.Minute
+
+// How many JetStream messages we ask for at once, and how long the server
+// holds the request open when there are none
+const (
+	natsPullBatch   = 20
+	natsPullExpires = 30 * time.Second
+)
+
+// NATS subscribes to subjects on a NATS server, or reads them through a
+// durable JetStream consumer so nothing is missed while we're away.
+type NATS struct {
+	Bus
+
+	Server    BusServer
+	User      string
+	Password  string
+	Token     string
+	Subjects  []string
+	Queue     string
+	JetStream NATSJetStream
+}
+
+// NATSJetStream names the stream and durable consumer to read. Deliver
+// says where a new consumer starts: "new" (the default), "all" or "last".
+type NATSJetStream struct {
+	Stream  string
+	Durable string
+	Deliver string
+}
+
+type NATSConfig struct {
+	Type      string
+	Url       string
+	User      string
+	Password  string
+	Token     string
+	Subjects  []string
+	Queue     string
+	Jetstream NATSJetStream
+
+	BusConfig
+}
+
+type natsInfo struct {
+	Tls_Required bool
+}
+
+// natsMessage is a line from the server, with the payload that follows MSG
+// and HMSG.
+type natsMessage struct {
+	Op      string
+	Line    string
+	Subject string
+	Reply   string
+	Status  string
+	Headers map[string]string
+	Payload []byte
+}
+
+type natsConn struct {
+	conn net.Conn
+}
+
+// Send writes a command, followed by its payload for PUB.
+func (c *natsConn) Send(command string, payload []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if payload == nil {
+		_, err := io.WriteString(c.conn, command+"\r\n")
+		return err
+	}
+	_, err := c.conn.Write([]byte(fmt.Sprintf("%s %d\r\n%s\r\n", command, len(payload), payload)))
+	return err
+}
+
+func readNatsMessage(r *bufio.Reader) (msg natsMessage, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	msg.Line = strings.TrimRight(line, "\r\n")
+	fields := strings.Fields(msg.Line)
+	if len(fields) == 0 {
+		return
+	}
+	msg.Op = strings.ToUpper(fields[0])
+
+	// MSG <subject> <sid> [reply] <size>
+	// HMSG <subject> <sid> [reply] <header size> <total size>
+	var headerSize, size int
+	switch {
+	case msg.Op == "MSG" && len(fields) >= 4:
+		if len(fields) == 5 {
+			msg.Reply = fields[3]
+		}
+		size, err = strconv.Atoi(fields[len(fields)-1])
+	case msg.Op == "HMSG" && len(fields) >= 5:
+		if len(fields) == 6 {
+			msg.Reply = fields[3]
+		}
+		if headerSize, err = strconv.Atoi(fields[len(fields)-2]); err == nil {
+			size, err = strconv.Atoi(fields[len(fields)-1])
+		}
+	default:
+		return
+	}
+	if err != nil || size < headerSize || size > maxResponseBytes {
+		return msg, fmt.Errorf("bad nats message %q", msg.Line)
+	}
+	msg.Subject = fields[1]
+
+	body := make([]byte, size+2)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	msg.Headers, msg.Status = parseNatsHeaders(body[:headerSize])
+	msg.Payload = body[headerSize:size]
+	return
+}
+
+// parseNatsHeaders reads "NATS/1.0 404 No Messages\r\nKey: Value\r\n...",
+// returning the headers and the status code, if there is one.
+func parseNatsHeaders(block []byte) (map[string]string, string) {
+	headers := make(map[string]string)
+	lines := strings.Split(strings.TrimSpace(string(block)), "\r\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "NATS/1.0") {
+		return headers, ""
+	}
+
+	status := ""
+	if fields := strings.Fields(lines[0]); len(fields) > 1 {
+		status = fields[1]
+	}
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return headers, status
+}
+
+func (n *NATS) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject NATSConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Url == "" || len(configObject.Subjects) == 0 {
+		log.Printf("ERR nats source needs a url and subjects")
+		return
+	}
+	js := configObject.Jetstream
+	if (js.Stream == "") != (js.Durable == "") {
+		log.Printf("ERR nats source needs both a stream and a durable name for jetstream")
+		return
+	}
+	server, err := ParseBusServer(configObject.Url, []string{"tls"}, "4222", "4222")
+	if err != nil {
+		log.Printf("ERR nats source has a bad url: %s", err)
+		return
+	}
+	if !n.configureBus("nats", configObject.BusConfig, server.Address) {
+		return
+	}
+
+	n.Server = server
+	n.User = configObject.User
+	n.Password = configObject.Password
+	if server.User != nil {
+		n.User = server.User.Username()
+		n.Password, _ = server.User.Password()
+	}
+	n.Token = configObject.Token
+	n.Subjects = configObject.Subjects
+	n.Queue = configObject.Queue
+	n.JetStream = js
+	n.JetStream.Deliver = pickString(strings.ToLower(js.Deliver), "new")
+
+	fmt.Printf("Configured NATS: %s %s\n", n.Name, strings.Join(n.Subjects, ","))
+}
+
+// connect dials the server and introduces us. The server speaks first, and
+// says whether it wants TLS.
+func (n *NATS) connect() (*natsConn, *bufio.Reader, error) {
+	conn, err := (&net.Dialer{Timeout: 30 * time.Second}).Dial("tcp", n.Server.Address)
+	if err != nil {
+		log.Printf("ERR connecting to %s: %s", n.Server.Address, err)
+		return nil, nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(conn)
+	hello, err := readNatsMessage(reader)
+	if err != nil || hello.Op != "INFO" {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%s didn't say hello: %q", n.Server.Address, hello.Line)
+	}
+
+	var info natsInfo
+	json.Unmarshal([]byte(strings.TrimPrefix(hello.Line, hello.Op)), &info)
+	if n.Server.TLS || info.Tls_Required {
+		host, _, _ := net.SplitHostPort(n.Server.Address)
+		secure := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := secure.Handshake(); err != nil {
+			conn.Close()
+			log.Printf("ERR connecting to %s: %s", n.Server.Address, err)
+			return nil, nil, err
+		}
+		conn, reader = secure, bufio.NewReader(secure)
+	}
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"tls_required":  n.Server.TLS || info.Tls_Required,
+		"name":          "choirmaster",
+		"lang":          "go",
+		"version":       "1.0",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+		"user":          n.User,
+		"pass":          n.Password,
+		"auth_token":    n.Token,
+	})
+	c := &natsConn{conn: conn}
+	c.Send("CONNECT "+string(connect), nil)
+	c.Send("PING", nil)
+
+	for {
+		msg, err := readNatsMessage(reader)
+		if err != nil {
+			conn.Close()
+			log.Printf("ERR connecting to %s: %s", n.Server.Address, err)
+			return nil, nil, err
+		}
+
+		switch msg.Op {
+		case "PONG":
+			return c, reader, nil
+		case "-ERR":
+			conn.Close()
+			log.Printf("ERR %s refused our connection: %s", n.Server.Address, msg.Line)
+			if strings.Contains(strings.ToLower(msg.Line), "authorization") || strings.Contains(strings.ToLower(msg.Line), "authentication") {
+				return nil, nil, n.authFailed(n.Server.Address)
+			}
+			return nil, nil, fmt.Errorf("%s: %s", n.Server.Address, msg.Line)
+		}
+	}
+}
+
+// pull asks the durable consumer for the next batch of messages.
+func (n *NATS) pull(c *natsConn, inbox string) error {
+	request, _ := json.Marshal(map[string]interface{}{
+		"batch":   natsPullBatch,
+		"expires": natsPullExpires.Nanoseconds(),
+	})
+	return c.Send(fmt.Sprintf("PUB $JS.API.CONSUMER.MSG.NEXT.%s.%s %s.pull", n.JetStream.Stream, n.JetStream.Durable, inbox), request)
+}
+
+// createConsumer makes sure the durable consumer exists. Asking again with
+// the same config is harmless.
+func (n *NATS) createConsumer(c *natsConn, inbox string) error {
+	consumer := map[string]interface{}{
+		"durable_name":   n.JetStream.Durable,
+		"ack_policy":     "explicit",
+		"deliver_policy": n.JetStream.Deliver,
+	}
+	if len(n.Subjects) == 1 {
+		consumer["filter_subject"] = n.Subjects[0]
+	} else {
+		consumer["filter_subjects"] = n.Subjects
+	}
+
+	request, _ := json.Marshal(map[string]interface{}{
+		"stream_name": n.JetStream.Stream,
+		"config":      consumer,
+	})
+	return c.Send(fmt.Sprintf("PUB $JS.API.CONSUMER.DURABLE.CREATE.%s.%s %s.create", n.JetStream.Stream, n.JetStream.Durable, inbox), request)
+}
+
+// Session connects, subscribes and listens until the connection drops,
+// returning why it did.
+func (n *NATS) Session(conductor chan *choir.Note) error {
+	c, reader, err := n.connect()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	n.Health.Observe(nil, 0, conductor)
+
+	jetstream := n.JetStream.Durable != ""
+	random := make([]byte, 8)
+	rand.Read(random)
+	inbox := "_INBOX." + hex.EncodeToString(random)
+
+	if jetstream {
+		c.Send(fmt.Sprintf("SUB %s.* 1", inbox), nil)
+		if err := n.createConsumer(c, inbox); err != nil {
+			return err
+		}
+	} else {
+		for i, subject := range n.Subjects {
+			if err := c.Send(strings.TrimSpace(fmt.Sprintf("SUB %s %s %d", subject, n.Queue, i+1)), nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	received := 0
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(natsReadTimeout))
+		msg, err := readNatsMessage(reader)
+		if err != nil {
+			log.Printf("ERR reading from %s: %s", n.Server.Address, err)
+			return err
+		}
+
+		switch msg.Op {
+		case "PING":
+			c.Send("PONG", nil)
+		case "-ERR":
+			log.Printf("ERR %s: %s", n.Server.Address, msg.Line)
+			return fmt.Errorf("%s: %s", n.Server.Address, msg.Line)
+		case "MSG", "HMSG":
+			if !jetstream {
+				n.Deliver(msg, conductor)
+				continue
+			}
+
+			switch {
+			case msg.Subject == inbox+".create":
+				var created struct {
+					Error *struct {
+						Description string
+					}
+				}
+				json.Unmarshal(msg.Payload, &created)
+				if created.Error != nil {
+					log.Printf("ERR creating consumer %s on %s: %s", n.JetStream.Durable, n.Server.Address, created.Error.Description)
+					return fmt.Errorf("%s: %s", n.Server.Address, created.Error.Description)
+				}
+				received = 0
+				err = n.pull(c, inbox)
+			case msg.Status == "503":
+				log.Printf("ERR %s has no JetStream consumer %s", n.Server.Address, n.JetStream.Durable)
+				return fmt.Errorf("%s: no responders for %s", n.Server.Address, n.JetStream.Durable)
+			case msg.Status != "":
+				// The request expired or was cut short, ask again
+				received = 0
+				err = n.pull(c, inbox)
+			default:
+				n.Deliver(msg, conductor)
+
+				// Only acknowledged once it's been sung
+				if msg.Reply != "" {
+					err = c.Send("PUB "+msg.Reply, []byte{})
+				}
+				if received++; err == nil && received == natsPullBatch {
+					received = 0
+					err = n.pull(c, inbox)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Deliver sings a message, if the rules want it.
+func (n *NATS) Deliver(msg natsMessage, conductor chan *choir.Note) {
+	headers := make(map[string]interface{})
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	data := map[string]interface{}{
+		"subject": msg.Subject,
+		"tokens":  strings.Split(msg.Subject, "."),
+		"headers": headers,
+	}
+	if note := n.Hear(data, msg.Payload); note != nil {
+		conductor <- note
+	}
+}
+
+func (n *NATS) Run(conductor chan *choir.Note) {
+	if n.Notes == nil || n.Server.Address == "" {
+		return
+	}
+
+	for {
+		err := n.Session(conductor)
+		time.Sleep(n.Health.Observe(err, 5*time.Second, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered NATS")
+	RegisterFactory("nats", func() Servicer { return &NATS{} })
+}
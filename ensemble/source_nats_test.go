@@ -0,0 +1,134 @@
+package ensemble
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+func TestReadNatsMessage(t *testing.T) {
+	tests := []struct {
+		raw     string
+		op      string
+		subject string
+		reply   string
+		status  string
+		headers map[string]string
+		payload string
+	}{
+		{"INFO {\"server_id\":\"x\"}\r\n", "INFO", "", "", "", nil, ""},
+		{"PING\r\n", "PING", "", "", "", nil, ""},
+		{"+OK\r\n", "+OK", "", "", "", nil, ""},
+		{"MSG deploys.api 1 5\r\nhello\r\n", "MSG", "deploys.api", "", "", map[string]string{}, "hello"},
+		{"MSG deploys.api 1 _INBOX.x 5\r\nhello\r\n", "MSG", "deploys.api", "_INBOX.x", "", map[string]string{}, "hello"},
+		{"msg a 1 0\r\n\r\n", "MSG", "a", "", "", map[string]string{}, ""},
+		{"HMSG a 1 23 28\r\nNATS/1.0\r\nEnv: prod\r\n\r\nhello\r\n", "HMSG", "a", "", "", map[string]string{"Env": "prod"}, "hello"},
+		{"HMSG _INBOX.x.pull 1 $JS.ACK.s.c.1 28 28\r\nNATS/1.0 404 No Messages\r\n\r\n\r\n", "HMSG", "_INBOX.x.pull", "$JS.ACK.s.c.1", "404", map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		msg, err := readNatsMessage(bufio.NewReader(strings.NewReader(tt.raw)))
+		if err != nil {
+			t.Errorf("readNatsMessage(%q): %s", tt.raw, err)
+			continue
+		}
+		if msg.Op != tt.op || msg.Subject != tt.subject || msg.Reply != tt.reply || msg.Status != tt.status || string(msg.Payload) != tt.payload {
+			t.Errorf("readNatsMessage(%q) = %+v", tt.raw, msg)
+		}
+		if tt.headers != nil && !reflect.DeepEqual(msg.Headers, tt.headers) {
+			t.Errorf("readNatsMessage(%q) headers = %v, want %v", tt.raw, msg.Headers, tt.headers)
+		}
+	}
+
+	for _, raw := range []string{"", "MSG a 1 x\r\n", "HMSG a 1 10 5\r\n", "MSG a 1 5\r\nhel"} {
+		if _, err := readNatsMessage(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("readNatsMessage(%q) should fail", raw)
+		}
+	}
+}
+
+func TestParseNatsHeaders(t *testing.T) {
+	tests := []struct {
+		block   string
+		headers map[string]string
+		status  string
+	}{
+		{"", map[string]string{}, ""},
+		{"garbage\r\n", map[string]string{}, ""},
+		{"NATS/1.0\r\n\r\n", map[string]string{}, ""},
+		{"NATS/1.0 503\r\n\r\n", map[string]string{}, "503"},
+		{"NATS/1.0 408 Request Timeout\r\nNats-Pending-Messages: 20\r\n\r\n", map[string]string{"Nats-Pending-Messages": "20"}, "408"},
+		{"NATS/1.0\r\nA: 1\r\nB:2\r\nbroken\r\nC: a:b\r\n\r\n", map[string]string{"A": "1", "B": "2", "C": "a:b"}, ""},
+	}
+	for _, tt := range tests {
+		headers, status := parseNatsHeaders([]byte(tt.block))
+		if !reflect.DeepEqual(headers, tt.headers) || status != tt.status {
+			t.Errorf("parseNatsHeaders(%q) = %v %q, want %v %q", tt.block, headers, status, tt.headers, tt.status)
+		}
+	}
+}
+
+func TestNatsSession(t *testing.T) {
+	ponged := make(chan bool, 1)
+	address := fakeBroker(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		expect := func(prefix string) string {
+			line, err := reader.ReadString('\n')
+			if err != nil || !strings.HasPrefix(line, prefix) {
+				t.Errorf("server wanted %s, got %q %v", prefix, line, err)
+			}
+			return line
+		}
+
+		io.WriteString(conn, "INFO {\"server_id\":\"fake\",\"headers\":true}\r\n")
+		if connect := expect("CONNECT "); !strings.Contains(connect, `"user":"alice"`) {
+			t.Errorf("CONNECT without our user: %q", connect)
+		}
+		expect("PING")
+		io.WriteString(conn, "PONG\r\n")
+		expect("SUB deploys.* workers 1")
+
+		io.WriteString(conn, "PING\r\n")
+		expect("PONG")
+		ponged <- true
+
+		headers, payload := "NATS/1.0\r\nEnv: prod\r\n\r\n", `{"app":"api","user":"alice"}`
+		fmt.Fprintf(conn, "HMSG deploys.api 1 %d %d\r\n%s%s\r\n", len(headers), len(headers)+len(payload), headers, payload)
+	})
+
+	n := &NATS{}
+	n.Configure(map[string]interface{}{
+		"url":      "nats://alice:secret@" + address,
+		"subjects": []string{"deploys.*"},
+		"queue":    "workers",
+		"label":    "Deploy:{{index .tokens 1}}",
+		"text":     "{{.user}} deployed {{.app}} to {{.headers.Env}}",
+	})
+
+	conductor := make(chan *choir.Note, 10)
+	done := make(chan error, 1)
+	go func() { done <- n.Session(conductor) }()
+
+	note := waitForNote(t, conductor)
+	if note.Label != "Deploy:api" || note.Text != "alice deployed api to prod" {
+		t.Errorf("note = %q %q, want %q %q", note.Label, note.Text, "Deploy:api", "alice deployed api to prod")
+	}
+	if len(ponged) == 0 {
+		t.Error("the server's PING wasn't answered")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Session ended without an error when the server hung up")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Session didn't notice the server hanging up")
+	}
+}
@@ -0,0 +1,431 @@
+package ensemble
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+// How long XREADGROUP waits for new entries before asking again
+const redisBlock = 30 * time.Second
+
+// Most stream entries we read at once
+const redisCount = 50
+
+// Redis listens to pub/sub channels and reads streams through a consumer
+// group. Stream entries are acknowledged once they've been sung, so a
+// restart picks up whatever we hadn't finished with.
+type Redis struct {
+	Bus
+
+	Server   BusServer
+	Username string
+	Password string
+	Db       int
+	Channels []string
+	Streams  []string
+	Group    string
+	Consumer string
+	Start    string
+	Field    string
+}
+
+type RedisConfig struct {
+	Type     string
+	Url      string
+	Username string
+	Password string
+	Db       int
+	Channels []string
+	Streams  []string
+	Group    string
+	Consumer string
+	Start    string
+	Field    string
+
+	BusConfig
+}
+
+// redisError is an error reply, like "WRONGPASS invalid password".
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Send writes a command as an array of bulk strings.
+func (c *redisConn) Send(args ...string) error {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := io.WriteString(c.conn, command)
+	return err
+}
+
+// Do sends a command and reads its reply, waiting at most wait.
+func (c *redisConn) Do(wait time.Duration, args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	return c.Read()
+}
+
+// Read returns the next reply: a string, int64, []byte, []interface{} or
+// nil. Error replies are returned as a redisError.
+func (c *redisConn) Read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		if size > maxResponseBytes {
+			return nil, fmt.Errorf("redis reply of %d bytes is too big", size)
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, bulk); err != nil {
+			return nil, err
+		}
+		return bulk[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.Read(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("bad redis reply %q", line)
+}
+
+// redisString reads a bulk or simple string reply.
+func redisString(reply interface{}) string {
+	switch v := reply.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func (r *Redis) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject RedisConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Url == "" || len(configObject.Channels)+len(configObject.Streams) == 0 {
+		log.Printf("ERR redis source needs a url and channels or streams")
+		return
+	}
+	server, err := ParseBusServer(configObject.Url, []string{"rediss"}, "6379", "6379")
+	if err != nil {
+		log.Printf("ERR redis source has a bad url: %s", err)
+		return
+	}
+	if !r.configureBus("redis", configObject.BusConfig, server.Address) {
+		return
+	}
+
+	r.Server = server
+	r.Username = configObject.Username
+	r.Password = configObject.Password
+	if server.User != nil {
+		r.Username = server.User.Username()
+		r.Password, _ = server.User.Password()
+	}
+	r.Db = configObject.Db
+	if db, err := strconv.Atoi(strings.Trim(server.Path, "/")); err == nil {
+		r.Db = db
+	}
+
+	r.Channels = configObject.Channels
+	r.Streams = configObject.Streams
+	r.Group = pickString(configObject.Group, "choirmaster")
+	hostname, _ := os.Hostname()
+	r.Consumer = pickString(configObject.Consumer, pickString(hostname, "choirmaster"))
+	r.Start = pickString(configObject.Start, "$")
+	r.Field = pickString(configObject.Field, "payload")
+
+	fmt.Printf("Configured Redis: %s %s\n", r.Name, strings.Join(append(r.Channels, r.Streams...), ","))
+}
+
+// connect dials the server, logs in and picks the database.
+func (r *Redis) connect() (*redisConn, error) {
+	conn, err := r.Server.Dial()
+	if err != nil {
+		log.Printf("ERR connecting to %s: %s", r.Server.Address, err)
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if r.Password != "" {
+		auth := []string{"AUTH", r.Password}
+		if r.Username != "" {
+			auth = []string{"AUTH", r.Username, r.Password}
+		}
+		if _, err := c.Do(30*time.Second, auth...); err != nil {
+			conn.Close()
+			log.Printf("ERR %s refused our login: %s", r.Server.Address, err)
+			if _, ok := err.(redisError); ok {
+				return nil, r.authFailed(r.Server.Address)
+			}
+			return nil, err
+		}
+	}
+
+	if r.Db != 0 {
+		if _, err := c.Do(30*time.Second, "SELECT", strconv.Itoa(r.Db)); err != nil {
+			conn.Close()
+			log.Printf("ERR selecting database %d on %s: %s", r.Db, r.Server.Address, err)
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Subscribe listens to the channels until the connection drops. Channels
+// with glob characters are subscribed to as patterns. Pub/sub needs a
+// connection of its own, so it keeps its own health.
+func (r *Redis) Subscribe(health *SourceHealth, conductor chan *choir.Note) error {
+	c, err := r.connect()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	channels, patterns := []string{"SUBSCRIBE"}, []string{"PSUBSCRIBE"}
+	for _, channel := range r.Channels {
+		if strings.ContainsAny(channel, "*?[") {
+			patterns = append(patterns, channel)
+		} else {
+			channels = append(channels, channel)
+		}
+	}
+	for _, command := range [][]string{channels, patterns} {
+		if len(command) > 1 {
+			if err := c.Send(command...); err != nil {
+				return err
+			}
+		}
+	}
+
+	health.Observe(nil, 0, conductor)
+
+	// Pub/sub connections are quiet until someone publishes
+	c.conn.SetReadDeadline(time.Time{})
+	for {
+		reply, err := c.Read()
+		if err != nil {
+			log.Printf("ERR reading from %s: %s", r.Server.Address, err)
+			return err
+		}
+
+		// ["message", channel, payload] or ["pmessage", pattern, channel, payload]
+		push, _ := reply.([]interface{})
+		if len(push) < 3 {
+			continue
+		}
+		channel, payload := push[1], push[2]
+		switch redisString(push[0]) {
+		case "message":
+		case "pmessage":
+			if len(push) < 4 {
+				continue
+			}
+			channel, payload = push[2], push[3]
+		default:
+			continue
+		}
+
+		data := map[string]interface{}{"channel": redisString(channel)}
+		if note := r.Hear(data, []byte(redisString(payload))); note != nil {
+			conductor <- note
+		}
+	}
+}
+
+// Consume reads the streams through the consumer group until the connection
+// drops. It starts with entries we were given before but never
+// acknowledged, then waits for new ones.
+func (r *Redis) Consume(conductor chan *choir.Note) error {
+	c, err := r.connect()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	for _, stream := range r.Streams {
+		_, err := c.Do(30*time.Second, "XGROUP", "CREATE", stream, r.Group, r.Start, "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			log.Printf("ERR creating group %s on %s: %s", r.Group, stream, err)
+			return err
+		}
+	}
+
+	pending := true
+	for {
+		command := []string{"XREADGROUP", "GROUP", r.Group, r.Consumer, "COUNT", strconv.Itoa(redisCount)}
+		if !pending {
+			command = append(command, "BLOCK", strconv.Itoa(int(redisBlock/time.Millisecond)))
+		}
+		command = append(command, "STREAMS")
+		command = append(command, r.Streams...)
+		for range r.Streams {
+			if pending {
+				command = append(command, "0")
+			} else {
+				command = append(command, ">")
+			}
+		}
+
+		reply, err := c.Do(redisBlock+30*time.Second, command...)
+		if err != nil {
+			log.Printf("ERR reading streams from %s: %s", r.Server.Address, err)
+			return err
+		}
+		r.Health.Observe(nil, 0, conductor)
+
+		// [[stream, [[id, [field, value, ...]], ...]], ...]
+		entries := 0
+		streams, _ := reply.([]interface{})
+		for _, s := range streams {
+			stream, _ := s.([]interface{})
+			if len(stream) < 2 {
+				continue
+			}
+			name := redisString(stream[0])
+			items, _ := stream[1].([]interface{})
+
+			for _, item := range items {
+				entry, _ := item.([]interface{})
+				if len(entry) < 2 {
+					continue
+				}
+				id := redisString(entry[0])
+				entries++
+
+				// Pending entries that were deleted come back without fields
+				if fields, ok := entry[1].([]interface{}); ok {
+					r.Deliver(name, id, fields, conductor)
+				}
+
+				// Only acknowledged once it's been sung
+				if _, err := c.Do(30*time.Second, "XACK", name, r.Group, id); err != nil {
+					log.Printf("ERR acknowledging %s %s: %s", name, id, err)
+					return err
+				}
+			}
+		}
+
+		// Pending entries come a page at a time, until there are none left
+		if pending && entries == 0 {
+			pending = false
+		}
+	}
+}
+
+// Deliver sings a stream entry, if the rules want it. The entry's fields
+// are available to templates, and the configured field is the payload.
+func (r *Redis) Deliver(stream, id string, fields []interface{}, conductor chan *choir.Note) {
+	values := make(map[string]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		values[redisString(fields[i])] = redisString(fields[i+1])
+	}
+	data := make(map[string]interface{})
+	for k, v := range values {
+		data[k] = v
+	}
+
+	var payload []byte
+	if value, ok := values[r.Field]; ok {
+		// Hear decodes it into .payload
+		payload = []byte(value.(string))
+		delete(data, r.Field)
+	} else {
+		data["payload"] = values
+	}
+
+	// These come from Redis, the entry's fields can't replace them
+	data["fields"] = values
+	data["stream"] = stream
+	data["id"] = id
+
+	if note := r.Hear(data, payload); note != nil {
+		conductor <- note
+	}
+}
+
+func (r *Redis) Run(conductor chan *choir.Note) {
+	if r.Notes == nil || r.Server.Address == "" {
+		return
+	}
+
+	if len(r.Channels) > 0 {
+		health := SourceHealth{Name: r.Name, Choir: r.Choir}
+		go func() {
+			for {
+				err := r.Subscribe(&health, conductor)
+				time.Sleep(health.Observe(err, 5*time.Second, conductor))
+			}
+		}()
+	}
+
+	if len(r.Streams) == 0 {
+		return
+	}
+	for {
+		err := r.Consume(conductor)
+		time.Sleep(r.Health.Observe(err, 5*time.Second, conductor))
+	}
+}
+
+func init() {
+	fmt.Println("Registered Redis")
+	RegisterFactory("redis", func() Servicer { return &Redis{} })
+}
@@ -0,0 +1,163 @@
+package ensemble
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+)
+
+func TestRedisRead(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", int64(42)},
+		{":-1\r\n", int64(-1)},
+		{"$5\r\nhello\r\n", []byte("hello")},
+		{"$0\r\n\r\n", []byte{}},
+		{"$7\r\na\r\nb\r\nc\r\n", []byte("a\r\nb\r\nc")},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*0\r\n", []interface{}{}},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{[]byte("a"), int64(1)}},
+		{"*2\r\n-ERR nope\r\n+OK\r\n", []interface{}{nil, "OK"}},
+		{"*2\r\n*1\r\n+x\r\n$-1\r\n", []interface{}{[]interface{}{"x"}, nil}},
+	}
+	for _, tt := range tests {
+		c := &redisConn{reader: bufio.NewReader(strings.NewReader(tt.raw))}
+		got, err := c.Read()
+		if err != nil {
+			t.Errorf("Read(%q): %s", tt.raw, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Read(%q) = %#v, want %#v", tt.raw, got, tt.want)
+		}
+	}
+
+	c := &redisConn{reader: bufio.NewReader(strings.NewReader("-WRONGPASS invalid password\r\n"))}
+	if _, err := c.Read(); err != redisError("WRONGPASS invalid password") {
+		t.Errorf("Read of an error reply = %v, want a redisError", err)
+	}
+
+	for _, raw := range []string{"", "\r\n", "?x\r\n", ":x\r\n", "$5\r\nhel", "$999999999\r\n", "*2\r\n+OK\r\n"} {
+		c := &redisConn{reader: bufio.NewReader(strings.NewReader(raw))}
+		if _, err := c.Read(); err == nil {
+			t.Errorf("Read(%q) should fail", raw)
+		}
+	}
+}
+
+func TestRedisDeliver(t *testing.T) {
+	r := &Redis{}
+	r.Configure(map[string]interface{}{
+		"url":     "localhost",
+		"streams": []string{"deploys"},
+		"label":   "{{.stream}}:{{.id}}",
+		"text":    "{{.app}} {{.user}}",
+	})
+
+	tests := []struct {
+		fields []interface{}
+		text   string
+	}{
+		{[]interface{}{"app", "api", "user", "alice"}, "api alice"},
+		{[]interface{}{"payload", `{"app":"api","user":"alice"}`}, "api alice"},
+		{[]interface{}{"payload", `{"app":"api","stream":"spoofed"}`, "user", "bob", "id", "0-0"}, "api bob"},
+		{[]interface{}{"stream", "spoofed", "id", "0-0", "app", "api"}, "api"},
+	}
+	for _, tt := range tests {
+		conductor := make(chan *choir.Note, 1)
+		r.Deliver("deploys", "1-0", tt.fields, conductor)
+		if len(conductor) == 0 {
+			t.Errorf("Deliver(%q) sang nothing", tt.fields)
+			continue
+		}
+		note := <-conductor
+		if note.Label != "deploys:1-0" || note.Text != tt.text {
+			t.Errorf("Deliver(%q) = %q %q, want %q %q", tt.fields, note.Label, note.Text, "deploys:1-0", tt.text)
+		}
+	}
+}
+
+func TestRedisConsume(t *testing.T) {
+	acked := make(chan string, 1)
+	address := fakeBroker(t, func(conn net.Conn) {
+		c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+		expect := func(want string) string {
+			reply, err := c.Read()
+			args := make([]string, 0)
+			items, _ := reply.([]interface{})
+			for _, item := range items {
+				args = append(args, redisString(item))
+			}
+			command := strings.Join(args, " ")
+			if err != nil || !strings.HasPrefix(command, want) {
+				t.Errorf("server wanted %s, got %q %v", want, command, err)
+			}
+			return command
+		}
+
+		expect("AUTH secret")
+		io.WriteString(conn, "+OK\r\n")
+		expect("SELECT 2")
+		io.WriteString(conn, "+OK\r\n")
+		expect("XGROUP CREATE deploys choirmaster $ MKSTREAM")
+		io.WriteString(conn, "-BUSYGROUP Consumer Group name already exists\r\n")
+
+		// What we were given before and never acknowledged comes first
+		if read := expect("XREADGROUP GROUP choirmaster test COUNT 50 STREAMS"); !strings.HasSuffix(read, "deploys 0") {
+			t.Errorf("pending read = %q", read)
+		}
+		io.WriteString(conn, "*1\r\n*2\r\n$7\r\ndeploys\r\n*1\r\n*2\r\n$3\r\n1-0\r\n*4\r\n$3\r\napp\r\n$3\r\napi\r\n$4\r\nuser\r\n$5\r\nalice\r\n")
+		acked <- expect("XACK deploys choirmaster")
+		io.WriteString(conn, ":1\r\n")
+
+		expect("XREADGROUP")
+		io.WriteString(conn, "*1\r\n*2\r\n$7\r\ndeploys\r\n*0\r\n")
+		if read := expect("XREADGROUP"); !strings.Contains(read, "BLOCK") || !strings.HasSuffix(read, "deploys >") {
+			t.Errorf("read for new entries = %q", read)
+		}
+	})
+
+	r := &Redis{}
+	r.Configure(map[string]interface{}{
+		"url":      "redis://:secret@" + address + "/2",
+		"streams":  []string{"deploys"},
+		"consumer": "test",
+		"label":    "Deploy:{{.app}}",
+		"text":     "{{.user}} deployed {{.app}} ({{.stream}} {{.id}})",
+	})
+
+	conductor := make(chan *choir.Note, 10)
+	done := make(chan error, 1)
+	go func() { done <- r.Consume(conductor) }()
+
+	note := waitForNote(t, conductor)
+	if note.Label != "Deploy:api" || note.Text != "alice deployed api (deploys 1-0)" {
+		t.Errorf("note = %q %q, want %q %q", note.Label, note.Text, "Deploy:api", "alice deployed api (deploys 1-0)")
+	}
+
+	select {
+	case ack := <-acked:
+		if ack != "XACK deploys choirmaster 1-0" {
+			t.Errorf("acknowledged with %q", ack)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the entry was never acknowledged")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Consume ended without an error when the server hung up")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Consume didn't notice the server hanging up")
+	}
+}
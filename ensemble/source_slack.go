@@ -0,0 +1,321 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const slackApiUrl = "https://slack.com/api"
+
+// Slack refuses requests signed longer ago than this, and so do we
+const slackSignatureTolerance = 5 * time.Minute
+
+// Slack's markup for mentions and links: <@U123>, <#C123|general>,
+// <https://example.com|label>
+var slackMarkup = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]*))?>`)
+
+// Message subtypes that are someone saying something
+var slackMessageSubtypes = []string{"", "thread_broadcast", "file_share", "me_message"}
+
+// Slack receives Events API callbacks, the successor to Campfire's
+// streaming API.
+type Slack struct {
+	Path          string
+	SigningSecret string
+	Token         string
+	Channels      []string
+	Bots          bool
+	Client        *http.Client
+	Choir         *choir.Choir
+
+	Events     chan SlackEvent
+	Deliveries *RecentSet
+	Users      *NameCache
+	Rooms      *NameCache
+}
+
+type SlackConfig struct {
+	Type           string
+	Key            string
+	Format         string
+	Path           string
+	Signing_Secret string
+	Bot_Token      string
+	Channels       []string
+	Bots           bool
+}
+
+type SlackPayload struct {
+	Type      string
+	Challenge string
+	Event_Id  string
+	Event     SlackEvent
+}
+
+type SlackEvent struct {
+	Type     string
+	Subtype  string
+	User     string
+	Text     string
+	Channel  string
+	Bot_Id   string
+	Reaction string
+	Item     struct {
+		Channel string
+	}
+	Item_User string
+}
+
+func (s *Slack) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject SlackConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	s.Path = configObject.Path
+	if s.Path == "" {
+		s.Path = "/slack"
+	}
+	s.SigningSecret = configObject.Signing_Secret
+	s.Token = configObject.Bot_Token
+	s.Channels = configObject.Channels
+	s.Bots = configObject.Bots
+	s.Client = &http.Client{Timeout: 30 * time.Second}
+	s.Choir = choir.NewChoir(configObject.Key)
+	s.Choir.Format = notetext.ParseFormat(configObject.Format)
+
+	s.Events = make(chan SlackEvent, 100)
+	s.Deliveries = NewRecentSet(1000)
+	s.Users = NewNameCache(deskNameTTL)
+	s.Rooms = NewNameCache(deskNameTTL)
+
+	if s.SigningSecret == "" {
+		log.Printf("ERR slack has no signing_secret, events can't be verified")
+	}
+
+	HandleInbound("Slack", s.Path, s)
+
+	fmt.Printf("Configured Slack: %s\n", s.Path)
+}
+
+// ValidSignature checks Slack's signature of "v0:<timestamp>:<body>".
+func (s *Slack) ValidSignature(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > slackSignatureTolerance || age < -slackSignatureTolerance {
+		return false
+	}
+
+	signed := append([]byte("v0:"+timestamp+":"), body...)
+	signature := strings.TrimPrefix(r.Header.Get("X-Slack-Signature"), "v0=")
+	return ValidHMAC(s.SigningSecret, signed, signature)
+}
+
+func (s *Slack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := ReadInbound(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.ValidSignature(r, body) {
+		log.Printf("ERR Slack event with a bad signature from %s", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload SlackPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Printf("ERR decoding Slack event: %s", err)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	// Slack checks the URL by asking us to echo a challenge
+	if payload.Type == "url_verification" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(payload.Challenge))
+		return
+	}
+
+	// Slack retries if we're slow, so answer now and look names up later
+	if payload.Type == "event_callback" {
+		if payload.Event_Id == "" || s.Deliveries.Add(payload.Event_Id) {
+			s.Events <- payload.Event
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// callApi calls a Slack Web API method. Slack answers errors with 200 and
+// "ok": false.
+func (s *Slack) callApi(method string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s?%s", slackApiUrl, method, query.Encode()), nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+
+	var raw json.RawMessage
+	if err := FetchJSON("Slack", s.Client, req, &raw); err != nil {
+		return err
+	}
+
+	var status struct {
+		Ok    bool
+		Error string
+	}
+	json.Unmarshal(raw, &status)
+	if !status.Ok {
+		log.Printf("ERR Slack %s: %s", method, status.Error)
+		return fmt.Errorf("slack %s: %s", method, status.Error)
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+// GetUser returns the user's display name, or their id if we can't find it.
+func (s *Slack) GetUser(id string) string {
+	name, err := s.Users.Get(id, func() (string, error) {
+		var found struct {
+			User struct {
+				Name      string
+				Real_Name string
+				Profile   struct {
+					Display_Name string
+				}
+			}
+		}
+		err := s.callApi("users.info", url.Values{"user": {id}}, &found)
+		u := found.User
+		return pickString(u.Profile.Display_Name, pickString(u.Real_Name, u.Name)), err
+	})
+	if err != nil || name == "" {
+		return id
+	}
+	return name
+}
+
+// GetRoom returns the channel's name, or its id if we can't find it.
+func (s *Slack) GetRoom(id string) string {
+	name, err := s.Rooms.Get(id, func() (string, error) {
+		var found struct {
+			Channel struct {
+				Name string
+			}
+		}
+		err := s.callApi("conversations.info", url.Values{"channel": {id}}, &found)
+		return found.Channel.Name, err
+	})
+	if err != nil || name == "" {
+		return id
+	}
+	return name
+}
+
+// Watching reports whether the channel is one we're configured to hear.
+// Channels can be configured by id or by name.
+func (s *Slack) Watching(channel string) bool {
+	if len(s.Channels) == 0 {
+		return true
+	}
+	if containsString(s.Channels, channel) {
+		return true
+	}
+
+	name := s.GetRoom(channel)
+	return containsFold(s.Channels, name) || containsFold(s.Channels, "#"+name)
+}
+
+// PlainText turns Slack's markup into text, naming the people and channels
+// that are mentioned.
+func (s *Slack) PlainText(text string) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(match string) string {
+		parts := slackMarkup.FindStringSubmatch(match)
+		target, label := parts[1], parts[2]
+
+		switch {
+		case strings.HasPrefix(target, "@"):
+			return "@" + pickString(label, s.GetUser(target[1:]))
+		case strings.HasPrefix(target, "#"):
+			return "#" + pickString(label, s.GetRoom(target[1:]))
+		case strings.HasPrefix(target, "!"):
+			return "@" + pickString(label, strings.SplitN(target[1:], "^", 2)[0])
+		default:
+			return pickString(label, target)
+		}
+	})
+
+	return html.UnescapeString(text)
+}
+
+// BuildNote returns nil for events we don't sing about: other channels,
+// edits and deletions, and bots unless they're wanted.
+func (s *Slack) BuildNote(e SlackEvent) *choir.Note {
+	channel := e.Channel
+	if e.Type == "reaction_added" {
+		channel = e.Item.Channel
+	}
+	if channel == "" || !s.Watching(channel) {
+		return nil
+	}
+	room := "#" + s.GetRoom(channel)
+
+	var label, sound, text string
+	switch e.Type {
+	case "message":
+		if !containsString(slackMessageSubtypes, e.Subtype) {
+			return nil
+		}
+		if e.Bot_Id != "" && !s.Bots {
+			return nil
+		}
+		label, sound = "message", "n/0"
+		text = fmt.Sprintf("(%s) %s: %s", room, s.GetUser(e.User), notetext.Clean(s.PlainText(e.Text), 500))
+	case "reaction_added":
+		label, sound = "reaction", "n/1"
+		text = fmt.Sprintf("(%s) %s reacted :%s: to %s", room, s.GetUser(e.User), e.Reaction, s.GetUser(e.Item_User))
+	case "member_joined_channel":
+		label, sound = "join", "g/1"
+		text = fmt.Sprintf("%s joined %s", s.GetUser(e.User), room)
+	default:
+		return nil
+	}
+
+	return &choir.Note{
+		Label: fmt.Sprintf("Slack:%s", label),
+		Sound: sound,
+		Text:  notetext.Render(text, s.Choir.Format),
+		Choir: s.Choir,
+	}
+}
+
+func (s *Slack) Run(conductor chan *choir.Note) {
+	for event := range s.Events {
+		if note := s.BuildNote(event); note != nil {
+			conductor <- note
+		}
+	}
+}
+
+func init() {
+	fmt.Println("Registered Slack")
+	RegisterFactory("slack", func() Servicer { return &Slack{} })
+}
@@ -0,0 +1,518 @@
+package ensemble
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// Unprivileged, so choirmaster needn't run as root. Point devices here or
+// forward 514 to it.
+const syslogDefaultListen = ":5514"
+
+// Notes a single host can send per minute before it's muted
+const syslogDefaultRateLimit = 20
+
+// Longest message we'll accept, TCP or UDP
+const syslogMaxMessage = 64 << 10
+
+// Most digits an octet count can have before we give up on the sender
+const syslogMaxLengthDigits = 10
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Syslog listens for syslog messages from network devices and daemons.
+type Syslog struct {
+	Listen      string
+	Protocols   []string
+	MinSeverity int
+	Facilities  []string
+	RateLimit   int
+	Choir       *choir.Choir
+
+	mu     sync.Mutex
+	hosts  map[string]*syslogHost
+	pruned time.Time
+}
+
+type SyslogConfig struct {
+	Type         string
+	Key          string
+	Format       string
+	Listen       string
+	Protocols    []string
+	Min_Severity string
+	Facilities   []string
+	Rate_Limit   int
+}
+
+// SyslogMessage is a parsed RFC 5424 or RFC 3164 message.
+type SyslogMessage struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcId    string
+	MsgId     string
+	Message   string
+}
+
+// How much a host has said this minute
+type syslogHost struct {
+	window  time.Time
+	count   int
+	dropped int
+}
+
+func (s *Syslog) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject SyslogConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	s.Listen = configObject.Listen
+	if s.Listen == "" {
+		s.Listen = syslogDefaultListen
+	}
+	s.Protocols = configObject.Protocols
+	if len(s.Protocols) == 0 {
+		s.Protocols = []string{"udp", "tcp"}
+	}
+
+	// Debug is too chatty to sing unless asked for
+	s.MinSeverity = SyslogSeverity(configObject.Min_Severity)
+	if s.MinSeverity < 0 {
+		s.MinSeverity = SyslogSeverity("info")
+	}
+	s.Facilities = configObject.Facilities
+
+	s.RateLimit = configObject.Rate_Limit
+	if s.RateLimit == 0 {
+		s.RateLimit = syslogDefaultRateLimit
+	}
+	s.hosts = make(map[string]*syslogHost)
+
+	s.Choir = choir.NewChoir(configObject.Key)
+	s.Choir.Format = notetext.ParseFormat(configObject.Format)
+
+	fmt.Printf("Configured syslog: %s %s\n", strings.Join(s.Protocols, "/"), s.Listen)
+}
+
+// SyslogSeverity returns the number for a severity name, or -1.
+func SyslogSeverity(name string) int {
+	for i, severity := range syslogSeverities {
+		if strings.EqualFold(name, severity) {
+			return i
+		}
+	}
+	switch strings.ToLower(name) {
+	case "error":
+		return 3
+	case "warn":
+		return 4
+	}
+	return -1
+}
+
+func (m SyslogMessage) SeverityName() string {
+	return syslogSeverities[m.Severity]
+}
+
+func (m SyslogMessage) FacilityName() string {
+	if m.Facility < len(syslogFacilities) {
+		return syslogFacilities[m.Facility]
+	}
+	return strconv.Itoa(m.Facility)
+}
+
+// ParseSyslog parses a message in either format, telling them apart by the
+// version number RFC 5424 puts after the priority. Anything after the
+// priority that doesn't look like RFC 3164 is kept whole as the message.
+func ParseSyslog(data []byte) (m SyslogMessage, err error) {
+	line := strings.TrimRight(string(data), "\r\n\x00")
+
+	if !strings.HasPrefix(line, "<") {
+		return m, errors.New("no priority")
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 || strings.Trim(line[1:end], "0123456789") != "" {
+		return m, errors.New("bad priority")
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return m, errors.New("bad priority")
+	}
+	m.Facility, m.Severity = pri/8, pri%8
+	line = line[end+1:]
+
+	if strings.HasPrefix(line, "1 ") {
+		return m, parse5424(&m, line[2:])
+	}
+	parse3164(&m, line)
+	return m, nil
+}
+
+// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func parse5424(m *SyslogMessage, line string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		space := strings.IndexByte(line, ' ')
+		if space < 0 {
+			return errors.New("short RFC 5424 header")
+		}
+		fields[i], line = line[:space], line[space+1:]
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+
+	if fields[0] != "" {
+		m.Timestamp, _ = time.Parse(time.RFC3339Nano, fields[0])
+	}
+	m.Hostname, m.AppName, m.ProcId, m.MsgId = fields[1], fields[2], fields[3], fields[4]
+
+	// We don't use structured data, just step over it
+	if strings.HasPrefix(line, "-") {
+		line = line[1:]
+	} else {
+		for strings.HasPrefix(line, "[") {
+			end := sdElementEnd(line)
+			if end < 0 {
+				return errors.New("unterminated structured data")
+			}
+			line = line[end+1:]
+		}
+	}
+
+	line = strings.TrimPrefix(line, " ")
+	m.Message = strings.TrimPrefix(line, "\ufeff")
+	return nil
+}
+
+// sdElementEnd finds the ] closing the element line starts with, skipping
+// escaped characters in quoted values.
+func sdElementEnd(line string) int {
+	quoted := false
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ']':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+func parse3164(m *SyslogMessage, line string) {
+	m.Message = line
+
+	if len(line) < 16 {
+		return
+	}
+	stamp, err := time.Parse(time.Stamp, line[:15])
+	if err != nil || line[15] != ' ' {
+		return
+	}
+	now := time.Now()
+	m.Timestamp = time.Date(now.Year(), stamp.Month(), stamp.Day(), stamp.Hour(), stamp.Minute(), stamp.Second(), 0, time.Local)
+	line = line[16:]
+
+	if space := strings.IndexByte(line, ' '); space > 0 {
+		m.Hostname, line = line[:space], line[space+1:]
+	}
+	m.Message = line
+
+	// The tag runs up to a [pid] or colon, if there is one
+	end := strings.IndexAny(line, "[: ")
+	if end <= 0 || line[end] == ' ' {
+		return
+	}
+	m.AppName = line[:end]
+	line = line[end:]
+	if line[0] == '[' {
+		if close := strings.IndexByte(line, ']'); close > 0 {
+			m.ProcId, line = line[1:close], line[close+1:]
+		}
+	}
+	m.Message = strings.TrimPrefix(strings.TrimPrefix(line, ":"), " ")
+}
+
+// SyslogSound is bad for errors and worse, neutral for the rest.
+func SyslogSound(severity int) string {
+	switch {
+	case severity <= 1:
+		return "b/3"
+	case severity == 2:
+		return "b/2"
+	case severity == 3:
+		return "b/1"
+	case severity == 4:
+		return "n/1"
+	default:
+		return "n/0"
+	}
+}
+
+// BuildNote turns a message from host into a note, or nil if we're not
+// interested in it.
+func (s *Syslog) BuildNote(m SyslogMessage, host string) *choir.Note {
+	if m.Severity > s.MinSeverity {
+		return nil
+	}
+	if len(s.Facilities) > 0 && !containsString(s.Facilities, m.FacilityName()) {
+		return nil
+	}
+
+	app := m.AppName
+	if app == "" {
+		app = m.FacilityName()
+	}
+	if m.Hostname != "" {
+		host = m.Hostname
+	}
+
+	text := fmt.Sprintf("%s %s: %s", host, app, notetext.Clean(m.Message, 500))
+	return &choir.Note{
+		Label: fmt.Sprintf("%s:%s", app, m.SeverityName()),
+		Sound: SyslogSound(m.Severity),
+		Text:  notetext.Render(text, s.Choir.Format),
+		Choir: s.Choir,
+	}
+}
+
+// Allow reports whether host can send another note this minute. A negative
+// limit turns limiting off.
+func (s *Syslog) Allow(host string) bool {
+	if s.RateLimit < 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.pruned) >= time.Minute {
+		s.prune(now)
+	}
+
+	h, ok := s.hosts[host]
+	if !ok {
+		h = &syslogHost{}
+		s.hosts[host] = h
+	}
+
+	if now.Sub(h.window) >= time.Minute {
+		if h.dropped > 0 {
+			log.Printf("Syslog muted %d messages from %s", h.dropped, host)
+		}
+		h.window, h.count, h.dropped = now, 0, 0
+	}
+
+	if h.count >= s.RateLimit {
+		h.dropped++
+		return false
+	}
+	h.count++
+	return true
+}
+
+// prune forgets hosts that haven't sent anything for a whole window, so
+// the map doesn't grow with every host that ever spoke to us.
+func (s *Syslog) prune(now time.Time) {
+	for host, h := range s.hosts {
+		if now.Sub(h.window) < time.Minute {
+			continue
+		}
+		if h.dropped > 0 {
+			log.Printf("Syslog muted %d messages from %s", h.dropped, host)
+		}
+		delete(s.hosts, host)
+	}
+	s.pruned = now
+}
+
+// Receive handles one message from addr.
+func (s *Syslog) Receive(data []byte, addr net.Addr, conductor chan *choir.Note) {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	m, err := ParseSyslog(data)
+	if err != nil {
+		log.Printf("ERR bad syslog message from %s: %s: %s", host, err, snippet(data))
+		return
+	}
+
+	note := s.BuildNote(m, host)
+	if note == nil || !s.Allow(host) {
+		return
+	}
+	conductor <- note
+}
+
+func (s *Syslog) ServeUDP(conductor chan *choir.Note) {
+	conn, err := net.ListenPacket("udp", s.Listen)
+	if err != nil {
+		log.Printf("ERR syslog can't listen on udp %s: %s", s.Listen, err)
+		return
+	}
+	log.Printf("Syslog listening on udp %s", s.Listen)
+
+	buffer := make([]byte, syslogMaxMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Printf("ERR reading syslog: %s", err)
+			continue
+		}
+
+		// Some senders pack several messages into a datagram
+		for _, line := range bytes.Split(buffer[:n], []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				s.Receive(line, addr, conductor)
+			}
+		}
+	}
+}
+
+func (s *Syslog) ServeTCP(conductor chan *choir.Note) {
+	listener, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		log.Printf("ERR syslog can't listen on tcp %s: %s", s.Listen, err)
+		return
+	}
+	log.Printf("Syslog listening on tcp %s", s.Listen)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("ERR accepting syslog connection: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.serveConn(conn, conductor)
+	}
+}
+
+// serveConn reads messages from a TCP connection, framed either by length
+// or by newlines (RFC 6587).
+func (s *Syslog) serveConn(conn net.Conn, conductor chan *choir.Note) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, 4096)
+
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var message []byte
+		if first[0] >= '0' && first[0] <= '9' {
+			message, err = readOctetCounted(reader)
+		} else {
+			message, err = readLine(reader)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("ERR reading syslog from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if len(bytes.TrimSpace(message)) > 0 {
+			s.Receive(message, conn.RemoteAddr(), conductor)
+		}
+	}
+}
+
+func readOctetCounted(reader *bufio.Reader) ([]byte, error) {
+	var length []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == ' ' {
+			break
+		}
+		length = append(length, b)
+		if len(length) > syslogMaxLengthDigits {
+			return nil, fmt.Errorf("bad message length %q...", length)
+		}
+	}
+	n, err := strconv.Atoi(string(length))
+	if err != nil || n <= 0 || n > syslogMaxMessage {
+		return nil, fmt.Errorf("bad message length %q", length)
+	}
+
+	message := make([]byte, n)
+	_, err = io.ReadFull(reader, message)
+	return message, err
+}
+
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > syslogMaxMessage {
+			return nil, errors.New("message too long")
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+func (s *Syslog) Run(conductor chan *choir.Note) {
+	if s.Choir == nil {
+		return
+	}
+
+	for _, protocol := range s.Protocols {
+		switch strings.ToLower(protocol) {
+		case "udp":
+			go s.ServeUDP(conductor)
+		case "tcp":
+			go s.ServeTCP(conductor)
+		default:
+			log.Printf("ERR syslog can't listen on %s", protocol)
+		}
+	}
+}
+
+func init() {
+	fmt.Println("Registered Syslog")
+	RegisterFactory("syslog", func() Servicer { return &Syslog{} })
+}
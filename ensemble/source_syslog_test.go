@@ -0,0 +1,82 @@
+package ensemble
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		raw      string
+		facility int
+		severity int
+		hostname string
+		app      string
+		procId   string
+		message  string
+	}{
+		{"<0>boom", 0, 0, "", "", "", "boom"},
+		{"<191>Oct 11 22:14:15 router sshd[42]: login failed\n", 23, 7, "router", "sshd", "42", "login failed"},
+		{"<34>Oct  1 22:14:15 mymachine su: 'su root' failed", 4, 2, "mymachine", "su", "", "'su root' failed"},
+		{"<13>just some text", 1, 5, "", "", "", "just some text"},
+		{"<165>1 2003-10-11T22:14:15.003Z host.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventID=\"1011\"] An application event", 20, 5, "host.example.com", "evntslog", "", "An application event"},
+		{"<14>1 - - app 123 - - \ufeffhello", 1, 6, "", "app", "123", "hello"},
+		{"<007>leading zeros", 0, 7, "", "", "", "leading zeros"},
+	}
+	for _, tt := range tests {
+		m, err := ParseSyslog([]byte(tt.raw))
+		if err != nil {
+			t.Errorf("ParseSyslog(%q): %s", tt.raw, err)
+			continue
+		}
+		if m.Facility != tt.facility || m.Severity != tt.severity || m.Hostname != tt.hostname || m.AppName != tt.app || m.ProcId != tt.procId || m.Message != tt.message {
+			t.Errorf("ParseSyslog(%q) = %+v", tt.raw, m)
+		}
+	}
+
+	bad := []string{
+		"",
+		"no priority",
+		"<>empty",
+		"<-1>negative",
+		"<-9>negative facility",
+		"<+7>signed",
+		"< 7>spaced",
+		"<1a>letters",
+		"<192>too high",
+		"<1000>too long",
+		"<13",
+		"<165>1 2003-10-11T22:14:15.003Z host",
+		"<165>1 - host app - - [unterminated",
+	}
+	for _, raw := range bad {
+		if m, err := ParseSyslog([]byte(raw)); err == nil {
+			t.Errorf("ParseSyslog(%q) = %+v, should fail", raw, m)
+		}
+	}
+}
+
+func TestReadOctetCounted(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"5 hello", "hello"},
+		{"12 <13>hi there<14>next", "<13>hi there"},
+	}
+	for _, tt := range tests {
+		got, err := readOctetCounted(bufio.NewReader(strings.NewReader(tt.raw)))
+		if err != nil {
+			t.Errorf("readOctetCounted(%q): %s", tt.raw, err)
+		} else if string(got) != tt.want {
+			t.Errorf("readOctetCounted(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	bad := []string{"", "5", "0 ", "x5 hello", "-5 hello", "70000 hello", "5 hel", strings.Repeat("1", 100000)}
+	for _, raw := range bad {
+		if _, err := readOctetCounted(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("readOctetCounted(%.20q) should fail", raw)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// Stripe refuses signatures older than this, and so do we
+const webhookStripeTolerance = 5 * time.Minute
+
+var webhookDefaultTemplate = NoteTemplate{
+	Label: "{{.source}}",
+	Sound: "n/0",
+	Text:  "{{.body}}",
+}
+
+// Webhook accepts JSON from anything that can post it and turns it into
+// notes with templates, configured entirely in config.json.
+type Webhook struct {
+	Name  string
+	Path  string
+	Token string
+	Hmac  WebhookHmac
+	Id    string
+
+	NoteRules
+
+	Choir      *choir.Choir
+	Queue      chan *choir.Note
+	Deliveries *RecentSet
+}
+
+type WebhookConfig struct {
+	Type      string
+	Key       string
+	Format    string
+	Name      string
+	Path      string
+	Token     string
+	Hmac      WebhookHmac
+	Id        string
+	Rules     []NoteRuleConfig
+	Unmatched string
+
+	NoteTemplate
+}
+
+// WebhookHmac says where the sender puts its signature of the body and how
+// it's written: "hex" (the default), "base64" or "stripe".
+type WebhookHmac struct {
+	Header   string
+	Secret   string
+	Encoding string
+}
+
+func (wh *Webhook) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject WebhookConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if configObject.Path == "" {
+		log.Printf("ERR webhook source needs a path")
+		return
+	}
+
+	wh.Path = configObject.Path
+	wh.Name = configObject.Name
+	if wh.Name == "" {
+		wh.Name = strings.Trim(wh.Path, "/")
+	}
+	wh.Token = configObject.Token
+	wh.Hmac = configObject.Hmac
+	wh.Hmac.Encoding = strings.ToLower(wh.Hmac.Encoding)
+	if wh.Token == "" && wh.Hmac.Secret == "" {
+		log.Printf("ERR webhook %s needs a token or an hmac secret, deliveries can't be verified", wh.Name)
+		return
+	}
+	if wh.Hmac.Secret != "" && wh.Hmac.Header == "" {
+		log.Printf("ERR webhook %s has an hmac secret but no header", wh.Name)
+		return
+	}
+	wh.Id = configObject.Id
+
+	var err error
+	wh.NoteRules, err = CompileRules(configObject.NoteTemplate, configObject.Rules, configObject.Unmatched, webhookDefaultTemplate)
+	if err != nil {
+		log.Printf("ERR configuring webhook %s: %s", wh.Name, err)
+		wh.Notes = nil
+		return
+	}
+
+	wh.Choir = choir.NewChoir(configObject.Key)
+	wh.Choir.Format = notetext.ParseFormat(configObject.Format)
+	wh.Queue = make(chan *choir.Note, 100)
+	wh.Deliveries = NewRecentSet(1000)
+
+	HandleInbound(fmt.Sprintf("webhook %s", wh.Name), wh.Path, wh)
+
+	fmt.Printf("Configured webhook: %s\n", wh.Name)
+}
+
+// Authorized checks the delivery's bearer token or signature, whichever
+// are configured. With neither there's nothing to check, so nothing gets in.
+func (wh *Webhook) Authorized(r *http.Request, body []byte) bool {
+	if wh.Token == "" && wh.Hmac.Secret == "" {
+		return false
+	}
+	if wh.Token != "" && !ValidToken(wh.Token, BearerToken(r)) {
+		return false
+	}
+
+	if wh.Hmac.Secret == "" {
+		return true
+	}
+
+	signature := r.Header.Get(wh.Hmac.Header)
+	switch wh.Hmac.Encoding {
+	case "base64":
+		return ValidHMACBase64(wh.Hmac.Secret, body, signature)
+	case "stripe":
+		return validStripeSignature(wh.Hmac.Secret, body, signature)
+	default:
+		return ValidHMAC(wh.Hmac.Secret, body, signature)
+	}
+}
+
+// Stripe signs "<timestamp>.<body>" and sends "t=<timestamp>,v1=<hex>",
+// with more than one v1 while a secret is being rolled.
+func validStripeSignature(secret string, body []byte, header string) bool {
+	var timestamp string
+	signatures := make([]string, 0)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > webhookStripeTolerance || age < -webhookStripeTolerance {
+		return false
+	}
+
+	signed := append([]byte(timestamp+"."), body...)
+	for _, signature := range signatures {
+		if ValidHMAC(secret, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers that carry credentials or signatures, which templates mustn't be
+// able to print into a note
+var webhookSecretHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie",
+	"X-Hub-Signature", "X-Hub-Signature-256", "X-Gitlab-Token",
+	"Stripe-Signature", "X-Slack-Signature",
+}
+
+// Data is what the templates see: the body's top-level fields, plus the
+// whole body, headers and query string, less the token and signatures.
+func (wh *Webhook) Data(r *http.Request, body []byte) map[string]interface{} {
+	headers := make(map[string]interface{})
+	for name := range r.Header {
+		if containsFold(webhookSecretHeaders, name) || strings.EqualFold(name, wh.Hmac.Header) {
+			continue
+		}
+		headers[name] = r.Header.Get(name)
+	}
+	query := make(map[string]interface{})
+	for name := range r.URL.Query() {
+		if name == "token" {
+			continue
+		}
+		query[name] = r.URL.Query().Get(name)
+	}
+
+	data := map[string]interface{}{
+		"headers": headers,
+		"query":   query,
+	}
+
+	// The body can't pass itself off as a different source
+	addPayload(data, "body", body)
+	data["source"] = wh.Name
+	return data
+}
+
+func (wh *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := ReadInbound(w, r)
+	if !ok {
+		return
+	}
+
+	if !wh.Authorized(r, body) {
+		log.Printf("ERR webhook %s with a bad token or signature from %s", wh.Name, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data := wh.Data(r, body)
+
+	// Senders retry, so deliveries with an id are only sung once
+	if wh.Id != "" {
+		delivery := LookupString(data, wh.Id)
+		if delivery != "" && !wh.Deliveries.Add(delivery) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	note, err := wh.Make(wh.Choir, data)
+	if err != nil {
+		log.Printf("ERR making note for webhook %s: %s", wh.Name, err)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+		return
+	}
+
+	if note != nil {
+		wh.Queue <- note
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (wh *Webhook) Run(conductor chan *choir.Note) {
+	if wh.Notes == nil {
+		return
+	}
+
+	for note := range wh.Queue {
+		conductor <- note
+	}
+}
+
+func init() {
+	fmt.Println("Registered Webhook")
+	RegisterFactory("webhook", func() Servicer { return &Webhook{} })
+}
@@ -0,0 +1,36 @@
+package ensemble
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookData(t *testing.T) {
+	wh := &Webhook{Name: "sentry", Hmac: WebhookHmac{Secret: "s3cret", Header: "X-Sentry-Signature"}}
+
+	r := httptest.NewRequest("POST", "/hooks/sentry?token=t0ken&project=api", strings.NewReader(""))
+	r.Header.Set("Authorization", "Bearer t0ken")
+	r.Header.Set("X-Sentry-Signature", "abc123")
+	r.Header.Set("X-Hub-Signature-256", "sha256=abc123")
+	r.Header.Set("X-Request-Id", "42")
+
+	data := wh.Data(r, []byte(`{"level":"error","source":"elsewhere"}`))
+	headers := data["headers"].(map[string]interface{})
+	query := data["query"].(map[string]interface{})
+
+	for _, name := range []string{"Authorization", "X-Sentry-Signature", "X-Hub-Signature-256"} {
+		if _, ok := headers[name]; ok {
+			t.Errorf("templates can see the %s header", name)
+		}
+	}
+	if _, ok := query["token"]; ok {
+		t.Error("templates can see the token")
+	}
+	if headers["X-Request-Id"] != "42" || query["project"] != "api" {
+		t.Errorf("headers = %v, query = %v, want the rest kept", headers, query)
+	}
+	if data["source"] != "sentry" || data["level"] != "error" {
+		t.Errorf("source = %v, level = %v", data["source"], data["level"])
+	}
+}
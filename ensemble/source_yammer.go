@@ -9,21 +9,27 @@ import (
 	"time"
 
 	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
 )
 
 const yammerActivityUrl = "https://www.yammer.com/api/v1/messages.json?access_token=%s&newer_than=%s"
 
+// Longest message text, in characters, that we'll send to the choir
+const yammerMaxText = 500
+
 type Yammer struct {
 	Url         string
 	AccessToken string
 	Choir       *choir.Choir
 	LastId      string
+	Health      SourceHealth
 }
 
 type YammerConfig struct {
-	Type string
-	Key  string
-	Http struct {
+	Type   string
+	Key    string
+	Format string
+	Http   struct {
 		Access_Token string
 	}
 }
@@ -99,35 +105,33 @@ func (ym *YammerMessage) GetCategory() string {
 	}
 }
 
+// GetText returns the message as plain text, preferring the full body and
+// falling back to the excerpt when the body is too long.
 func (ym *YammerMessage) GetText() string {
-	if len(ym.Body.Rich) < 500 {
-		return ym.Body.Rich
-	} else if len(ym.Content_Excerpt) > 500 {
-		return ym.Content_Excerpt[0:500]
-	} else {
-		return ym.Content_Excerpt
+	body := ym.Body.Plain
+	if body == "" {
+		body = notetext.FromHTML(ym.Body.Rich)
 	}
+
+	text := notetext.Collapse(body)
+	if len([]rune(text)) > yammerMaxText && ym.Content_Excerpt != "" {
+		text = notetext.Collapse(ym.Content_Excerpt)
+	}
+
+	return notetext.Truncate(text, yammerMaxText)
 }
 
-func (y *Yammer) FetchUpdates() (feed YammerFeed) {
+func (y *Yammer) FetchUpdates() (feed YammerFeed, err error) {
 	url := fmt.Sprintf(yammerActivityUrl, y.AccessToken, y.LastId)
 
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Printf("ERR making request for %s: %s", url, err)
+		log.Printf("ERR making request for Yammer messages: %s", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		log.Println("ERR Received a non-200 response from Yammer: ", resp.StatusCode)
-		return
-	}
-
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&feed)
-	if err != nil {
-		log.Printf("ERR decoding json from Yammer: %s\n%s", err, resp.Body)
+	if err = DecodeJSON("Yammer", resp, &feed); err != nil {
 		return
 	}
 
@@ -148,24 +152,26 @@ func (y *Yammer) Configure(config interface{}) {
 	}
 	y.Url = fmt.Sprintf(yammerActivityUrl, configObject.Http.Access_Token, "1")
 	y.AccessToken = configObject.Http.Access_Token
-	y.Choir = &choir.Choir{configObject.Key}
+	y.Choir = choir.NewChoir(configObject.Key)
+	y.Choir.Format = notetext.ParseFormat(configObject.Format)
+	y.Health = SourceHealth{Name: "Yammer", Choir: y.Choir}
 
 	// Prime the LastId
 	y.LastId = "1"
-	_ = y.FetchUpdates()
+	y.FetchUpdates()
 
 	fmt.Println("Configured Yammer")
 }
 
 func (y *Yammer) Run(conductor chan *choir.Note) {
 	for {
-		feed := y.FetchUpdates()
+		feed, err := y.FetchUpdates()
 
 		for _, message := range feed.Messages {
 			note := &choir.Note{
 				Label: message.GetCategory(),
 				Sound: message.SoundClass(),
-				Text:  fmt.Sprintf("%s: %s", feed.LookupUser(message.Sender_Id), message.GetText()),
+				Text:  notetext.Render(fmt.Sprintf("%s: %s", feed.LookupUser(message.Sender_Id), message.GetText()), y.Choir.Format),
 				Choir: y.Choir,
 			}
 
@@ -174,7 +180,7 @@ func (y *Yammer) Run(conductor chan *choir.Note) {
 			}()
 		}
 
-		time.Sleep(60 * time.Second)
+		time.Sleep(y.Health.Observe(err, 60*time.Second, conductor))
 	}
 }
 
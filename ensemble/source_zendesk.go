@@ -0,0 +1,608 @@
+package ensemble
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+const zendeskUrl = "https://%s.zendesk.com/api/v2"
+
+// Zendesk only allows 10 incremental export requests a minute
+const zendeskDefaultInterval = 60 * time.Second
+const zendeskMaxPages = 5
+
+// Zendesk follows on from Desk: it polls the incremental ticket export and
+// summarizes each changed ticket's audits since the last poll.
+type Zendesk struct {
+	Url       string
+	Subdomain string
+	Email     string
+	Token     string
+	Oauth     string
+	Choir     *choir.Choir
+	Interval  time.Duration
+
+	Client  *http.Client
+	Workers int
+
+	Users   *NameCache
+	Groups  *NameCache
+	Health  SourceHealth
+	Verbs   map[string]DeskVerb
+	Filters ZendeskFilters
+	Audits  *RecentSet
+	Cursor  ZendeskCursor
+}
+
+// ZendeskFilters limit which tickets make a sound. Empty filters match
+// every ticket.
+type ZendeskFilters struct {
+	Status   []string
+	Priority []string
+	Tags     []string
+	Groups   []string
+}
+
+type ZendeskConfig struct {
+	Type     string
+	Key      string
+	Format   string
+	Verbs    map[string]DeskVerb
+	Filters  ZendeskFilters
+	Workers  int
+	Interval int
+	Http     struct {
+		Subdomain   string
+		Email       string
+		Api_Token   string
+		Oauth_Token string
+	}
+}
+
+// ZendeskCursor is where the export got to, kept in the checkpoint store.
+type ZendeskCursor struct {
+	Cursor string
+	Since  time.Time
+}
+
+type ZendeskExport struct {
+	Tickets       []ZendeskTicket
+	After_Cursor  string
+	End_Of_Stream bool
+}
+
+type ZendeskTicket struct {
+	Id           int64
+	Subject      string
+	Status       string
+	Priority     string
+	Tags         []string
+	Group_Id     int64
+	Requester_Id int64
+	Updated_At   time.Time
+}
+
+type ZendeskAudits struct {
+	Audits []ZendeskAudit
+	Meta   struct {
+		Has_More bool
+	}
+	Links struct {
+		Next string
+	}
+}
+
+type ZendeskAudit struct {
+	Id         int64
+	Author_Id  int64
+	Created_At time.Time
+	Events     []ZendeskAuditEvent
+}
+
+type ZendeskAuditEvent struct {
+	Type           string
+	Field_Name     string
+	Value          interface{}
+	Previous_Value interface{}
+	Public         bool
+	Body           string
+	Score          string
+}
+
+// ZendeskAction is something someone did to a ticket, named like a Desk
+// history type so it reads the same way in summaries.
+type ZendeskAction struct {
+	Type    string
+	User    int64
+	Comment string
+}
+
+// Default verbs for Zendesk actions, overridable with "verbs" in config.
+var zendeskVerbs = map[string]DeskVerb{
+	"ticket_created":   {"created", "was created"},
+	"ticket_assigned":  {"assigned", "was assigned"},
+	"ticket_regrouped": {"reassigned", "was reassigned"},
+	"ticket_solved":    {"solved", "was solved"},
+	"ticket_closed":    {"closed", "was closed"},
+	"ticket_reopened":  {"reopened", "was reopened"},
+	"ticket_pending":   {"put on hold", "went pending"},
+	"status_changed":   {"changed the status of", "changed status"},
+	"priority_changed": {"reprioritized", "was reprioritized"},
+	"reply_created":    {"replied to", "was replied to"},
+	"customer_reply":   {"replied to", "got a customer reply"},
+	"note_created":     {"added a note to", "got a note"},
+	"rated_good":       {"rated", "was rated good"},
+	"rated_bad":        {"rated", "was rated bad"},
+	"tags_changed":     {},
+}
+
+func (z *Zendesk) Configure(config interface{}) {
+	jsonString, _ := json.Marshal(config)
+	var configObject ZendeskConfig
+	if err := json.Unmarshal(jsonString, &configObject); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	z.Subdomain = configObject.Http.Subdomain
+	z.Url = fmt.Sprintf(zendeskUrl, z.Subdomain)
+	z.Email = configObject.Http.Email
+	z.Token = configObject.Http.Api_Token
+	z.Oauth = configObject.Http.Oauth_Token
+	z.Choir = choir.NewChoir(configObject.Key)
+	z.Choir.Format = notetext.ParseFormat(configObject.Format)
+	z.Health = SourceHealth{Name: "Zendesk", Choir: z.Choir}
+
+	z.Interval = time.Duration(configObject.Interval) * time.Second
+	if z.Interval < zendeskDefaultInterval {
+		z.Interval = zendeskDefaultInterval
+	}
+
+	z.Workers = configObject.Workers
+	if z.Workers <= 0 {
+		z.Workers = deskDefaultWorkers
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = z.Workers
+	z.Client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+
+	z.Users = NewNameCache(deskNameTTL)
+	z.Groups = NewNameCache(deskNameTTL)
+	z.Verbs = configObject.Verbs
+	z.Filters = configObject.Filters
+	z.Audits = NewRecentSet(5000)
+
+	fmt.Printf("Configured Zendesk: %s\n", z.Subdomain)
+}
+
+// checkpointKey is unique to what the source watches and where it sings,
+// so two sources on one subdomain don't overwrite each other's cursor.
+func (z *Zendesk) checkpointKey() string {
+	f := z.Filters
+	filters := []string{strings.Join(f.Status, ","), strings.Join(f.Priority, ","), strings.Join(f.Tags, ","), strings.Join(f.Groups, ",")}
+	return fmt.Sprintf("zendesk:%s:%s:%s", z.Subdomain, z.Choir.Key, strings.Join(filters, ":"))
+}
+
+// Verb returns how the given action reads in a summary.
+func (z *Zendesk) Verb(action string) DeskVerb {
+	verb, ok := z.Verbs[action]
+	if !ok {
+		verb, ok = zendeskVerbs[action]
+	}
+	if !ok {
+		verb = DeskVerb{Active: "updated"}
+	}
+	if verb.Active != "" && verb.Passive == "" {
+		verb.Passive = "was " + verb.Active
+	}
+	return verb
+}
+
+func (zt *ZendeskTicket) GetGroupName(z *Zendesk) string {
+	if zt.Group_Id == 0 {
+		return ""
+	}
+
+	name, _ := z.Groups.Get(strconv.FormatInt(zt.Group_Id, 10), func() (string, error) {
+		var found struct {
+			Group struct {
+				Name string
+			}
+		}
+		err := z.GetUrl(fmt.Sprintf("/groups/%d.json", zt.Group_Id), &found)
+		return found.Group.Name, err
+	})
+
+	return name
+}
+
+// GetUserName looks up who did something. Zendesk itself (triggers and
+// automations) is -1 and has no name.
+func (z *Zendesk) GetUserName(user_id int64) string {
+	if user_id <= 0 {
+		return ""
+	}
+
+	name, _ := z.Users.Get(strconv.FormatInt(user_id, 10), func() (string, error) {
+		var found struct {
+			User struct {
+				Name string
+			}
+		}
+		err := z.GetUrl(fmt.Sprintf("/users/%d.json", user_id), &found)
+		return found.User.Name, err
+	})
+
+	return name
+}
+
+// Matches reports whether the ticket passes the configured filters.
+func (zt *ZendeskTicket) Matches(z *Zendesk) bool {
+	f := z.Filters
+
+	if len(f.Status) > 0 && !containsFold(f.Status, zt.Status) {
+		return false
+	}
+
+	if len(f.Priority) > 0 && !containsFold(f.Priority, zt.Priority) {
+		return false
+	}
+
+	if len(f.Tags) > 0 {
+		found := false
+		for _, tag := range zt.Tags {
+			if containsFold(f.Tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// Groups can be configured by id or by name
+	if len(f.Groups) > 0 {
+		if zt.Group_Id == 0 {
+			return false
+		}
+		if !containsString(f.Groups, strconv.FormatInt(zt.Group_Id, 10)) && !containsFold(f.Groups, zt.GetGroupName(z)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Actions works out what an audit did to the ticket.
+func (zt *ZendeskTicket) Actions(audit ZendeskAudit) []ZendeskAction {
+	actions := make([]ZendeskAction, 0)
+	add := func(actionType string, comment string) {
+		actions = append(actions, ZendeskAction{Type: actionType, User: audit.Author_Id, Comment: comment})
+	}
+
+	// Events aren't always in order, so look for the creation first: the
+	// comment it comes with is the description, not a reply
+	created := false
+	for _, event := range audit.Events {
+		if event.Type == "Create" {
+			created = true
+			add("ticket_created", "")
+			break
+		}
+	}
+
+	for _, event := range audit.Events {
+		switch event.Type {
+		case "Comment":
+			switch {
+			case created:
+				// The description the ticket was created with
+			case !event.Public:
+				add("note_created", "")
+			case audit.Author_Id == zt.Requester_Id:
+				add("customer_reply", "")
+			default:
+				add("reply_created", "")
+			}
+		case "Change":
+			if action := zendeskChange(event); action != "" {
+				add(action, "")
+			}
+		case "SatisfactionRating":
+			switch event.Score {
+			case "good":
+				add("rated_good", event.Body)
+			case "bad":
+				add("rated_bad", event.Body)
+			}
+		}
+	}
+
+	return actions
+}
+
+// zendeskChange names a field change, or returns "" for ones we ignore.
+func zendeskChange(event ZendeskAuditEvent) string {
+	value := fmt.Sprint(event.Value)
+	previous := fmt.Sprint(event.Previous_Value)
+
+	switch event.Field_Name {
+	case "status":
+		switch {
+		case value == "solved":
+			return "ticket_solved"
+		case value == "closed":
+			return "ticket_closed"
+		case previous == "solved" || previous == "closed":
+			return "ticket_reopened"
+		case value == "pending" || value == "hold":
+			return "ticket_pending"
+		default:
+			return "status_changed"
+		}
+	case "assignee_id":
+		return "ticket_assigned"
+	case "group_id":
+		return "ticket_regrouped"
+	case "priority":
+		return "priority_changed"
+	case "tags":
+		return "tags_changed"
+	default:
+		return ""
+	}
+}
+
+// GetAudits returns every audit of the ticket, oldest first.
+func (zt *ZendeskTicket) GetAudits(z *Zendesk) ([]ZendeskAudit, error) {
+	auditsPath := fmt.Sprintf("/tickets/%d/audits.json?page[size]=100", zt.Id)
+	all := make([]ZendeskAudit, 0)
+
+	for auditsPath != "" {
+		page := new(ZendeskAudits)
+		if err := z.GetUrl(auditsPath, page); err != nil {
+			return all, err
+		}
+		all = append(all, page.Audits...)
+
+		auditsPath = ""
+		if page.Meta.Has_More {
+			auditsPath = page.Links.Next
+		}
+	}
+
+	return all, nil
+}
+
+// RecentActions returns what was done to the ticket from since onwards,
+// skipping audits an earlier poll already sang.
+func (zt *ZendeskTicket) RecentActions(z *Zendesk, since time.Time) []ZendeskAction {
+	audits, err := zt.GetAudits(z)
+	if err != nil {
+		log.Printf("ERR getting audits for ticket %d: %s", zt.Id, err)
+	}
+
+	recent := make([]ZendeskAction, 0)
+	for _, audit := range audits {
+		if audit.Created_At.Before(since) || !z.Audits.Add(strconv.FormatInt(audit.Id, 10)) {
+			continue
+		}
+		recent = append(recent, zt.Actions(audit)...)
+	}
+
+	return recent
+}
+
+// Transition works out the most notable thing that happened to the ticket,
+// the way Desk cases do, with satisfaction ratings on top.
+func (zt *ZendeskTicket) Transition(actions []ZendeskAction) string {
+	types := make([]string, 0, len(actions))
+	for _, action := range actions {
+		types = append(types, action.Type)
+	}
+
+	switch {
+	case containsString(types, "rated_bad"):
+		return "bad_rating"
+	case containsString(types, "ticket_reopened"):
+		return "reopened"
+	case containsString(types, "ticket_created"):
+		return "new"
+	case containsString(types, "rated_good"):
+		return "good_rating"
+	case containsString(types, "ticket_solved"), containsString(types, "ticket_closed"):
+		return "resolved"
+	case containsString(types, "customer_reply"):
+		return "reply"
+	}
+
+	return "updated"
+}
+
+// ZendeskSoundClass is DeskSoundClass with sounds for satisfaction ratings.
+func ZendeskSoundClass(transition string) string {
+	switch transition {
+	case "bad_rating":
+		return "b/3"
+	case "good_rating":
+		return "g/2"
+	default:
+		return DeskSoundClass(transition)
+	}
+}
+
+// BuildDescription summarizes the actions as a sentence, e.g. "Alice
+// replied to and solved ticket #123", followed by the subject and any
+// satisfaction rating comment.
+func (zt *ZendeskTicket) BuildDescription(z *Zendesk, actions []ZendeskAction) string {
+	users := make([]string, 0)
+	user_verbs := make(map[string][]string)
+	comment := ""
+
+	for _, action := range actions {
+		if action.Comment != "" {
+			comment = action.Comment
+		}
+
+		verb := z.Verb(action.Type)
+		if verb.Active == "" {
+			continue
+		}
+		users = addAction(users, user_verbs, z.GetUserName(action.User), verb)
+	}
+
+	lines := []string{
+		summarizeActions(fmt.Sprintf("ticket #%d", zt.Id), users, user_verbs),
+		fmt.Sprintf("\"%s\"", notetext.Clean(zt.Subject, 200)),
+	}
+	if comment != "" {
+		lines = append(lines, fmt.Sprintf("Rating: %s", notetext.Clean(comment, 200)))
+	}
+	return notetext.Join(lines, z.Choir.Format)
+}
+
+// zendeskUpdate is a changed ticket waiting for a worker to summarize it.
+type zendeskUpdate struct {
+	ticket ZendeskTicket
+	since  time.Time
+	done   *sync.WaitGroup
+}
+
+func (z *Zendesk) Run(conductor chan *choir.Note) {
+	if z.Subdomain == "" {
+		return
+	}
+
+	if !Checkpoints.Load(z.checkpointKey(), &z.Cursor) {
+		z.Cursor = ZendeskCursor{Since: time.Now()}
+	}
+
+	updates := make(chan zendeskUpdate, 100)
+	for i := 0; i < z.Workers; i++ {
+		go z.work(updates, conductor)
+	}
+
+	for {
+		since := z.Cursor.Since
+		started := time.Now()
+		var done sync.WaitGroup
+		err := z.FetchUpdates(func(ticket ZendeskTicket) {
+			done.Add(1)
+			updates <- zendeskUpdate{ticket: ticket, since: since, done: &done}
+		})
+
+		// Only move on once everything found has been sung, or a restart
+		// would skip what the workers hadn't got to
+		done.Wait()
+		if err == nil {
+			z.Cursor.Since = started
+			Checkpoints.Save(z.checkpointKey(), z.Cursor)
+		}
+
+		time.Sleep(z.Health.Observe(err, z.Interval, conductor))
+	}
+}
+
+func (z *Zendesk) work(updates chan zendeskUpdate, conductor chan *choir.Note) {
+	for update := range updates {
+		z.sing(update, conductor)
+		update.done.Done()
+	}
+}
+
+// sing summarizes what happened to the ticket since the update's poll
+// started, if it passes the filters.
+func (z *Zendesk) sing(update zendeskUpdate, conductor chan *choir.Note) {
+	t := update.ticket
+	if !t.Matches(z) {
+		return
+	}
+
+	actions := t.RecentActions(z, update.since)
+	if len(actions) == 0 {
+		return
+	}
+
+	transition := t.Transition(actions)
+	conductor <- &choir.Note{
+		Label: fmt.Sprintf("Customer:%s", transition),
+		Sound: ZendeskSoundClass(transition),
+		Text:  t.BuildDescription(z, actions),
+		Choir: z.Choir,
+	}
+}
+
+func init() {
+	fmt.Println("Registered Zendesk")
+	RegisterFactory("zendesk", func() Servicer { return &Zendesk{} })
+}
+
+// FetchUpdates pages through the incremental export from the cursor,
+// handing each changed ticket to found. The first export starts a minute
+// ago, as recent as Zendesk allows. The cursor only moves on once every
+// page has been read, a failure starts again from where this one did.
+func (z *Zendesk) FetchUpdates(found func(ZendeskTicket)) error {
+	cursor := z.Cursor.Cursor
+	for page := 0; page < zendeskMaxPages; page++ {
+		query := url.Values{}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		} else {
+			query.Set("start_time", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+		}
+
+		export := new(ZendeskExport)
+		if err := z.GetUrl("/incremental/tickets/cursor.json?"+query.Encode(), export); err != nil {
+			return err
+		}
+
+		for _, ticket := range export.Tickets {
+			found(ticket)
+		}
+
+		if export.After_Cursor != "" {
+			cursor = export.After_Cursor
+		}
+		if export.End_Of_Stream {
+			break
+		}
+	}
+
+	z.Cursor.Cursor = cursor
+	return nil
+}
+
+// Generic API Getter
+func (z *Zendesk) GetUrl(path string, decode_object interface{}) error {
+	url := z.Url + path
+
+	// Links from the API, like audits' "next", are already absolute
+	if strings.HasPrefix(path, "https://") {
+		url = path
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Printf("ERR building request: %s", err)
+		return err
+	}
+
+	if z.Oauth != "" {
+		req.Header.Set("Authorization", "Bearer "+z.Oauth)
+	} else {
+		req.SetBasicAuth(z.Email+"/token", z.Token)
+	}
+
+	return FetchJSON("Zendesk", z.Client, req, decode_object)
+}
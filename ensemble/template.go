@@ -0,0 +1,286 @@
+package ensemble
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+// NoteTemplate is how generic sources, configured entirely in config.json,
+// turn whatever they receive into a note. Each field is a text/template
+// executed against the item, e.g. "Deploy:{{.app}}".
+type NoteTemplate struct {
+	Label string
+	Sound string
+	Text  string
+}
+
+// Functions available to note templates, on top of the text/template ones
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"title": func(s string) string {
+		first, size := utf8.DecodeRuneInString(s)
+		if size == 0 {
+			return s
+		}
+		return string(unicode.ToUpper(first)) + s[size:]
+	},
+	"trim":     strings.TrimSpace,
+	"replace":  func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains": func(substr, s string) bool { return strings.Contains(s, substr) },
+	"truncate": func(max int, s string) string { return notetext.Truncate(s, max) },
+	"html":     func(s string) string { return notetext.Collapse(notetext.FromHTML(s)) },
+	"default": func(def interface{}, value interface{}) interface{} {
+		if value == nil || fmt.Sprint(value) == "" {
+			return def
+		}
+		return value
+	},
+	"blank": blank,
+}
+
+// blank is appended to every action, see blankMissing.
+func blank(value interface{}) interface{} {
+	if value == nil {
+		return ""
+	}
+	return value
+}
+
+// NoteMaker is a compiled NoteTemplate.
+type NoteMaker struct {
+	label *template.Template
+	sound *template.Template
+	text  *template.Template
+}
+
+// Compile parses the template, using defaults for any field left empty.
+func (nt NoteTemplate) Compile(defaults NoteTemplate) (*NoteMaker, error) {
+	var err error
+	nm := new(NoteMaker)
+	if nm.label, err = parseTemplate("label", pickString(nt.Label, defaults.Label)); err != nil {
+		return nil, err
+	}
+	if nm.sound, err = parseTemplate("sound", pickString(nt.Sound, defaults.Sound)); err != nil {
+		return nil, err
+	}
+	if nm.text, err = parseTemplate("text", pickString(nt.Text, defaults.Text)); err != nil {
+		return nil, err
+	}
+	return nm, nil
+}
+
+// Over returns a template with any empty fields filled in from defaults.
+func (nt NoteTemplate) Over(defaults NoteTemplate) NoteTemplate {
+	return NoteTemplate{
+		Label: pickString(nt.Label, defaults.Label),
+		Sound: pickString(nt.Sound, defaults.Sound),
+		Text:  pickString(nt.Text, defaults.Text),
+	}
+}
+
+func pickString(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s template %q: %s", name, text, err)
+	}
+	blankMissing(t.Tree, t.Tree.Root)
+	return t, nil
+}
+
+// blankMissing pipes every action that prints through blank. Fields
+// missing from the JSON we're given are nil, which text/template would
+// otherwise print as "<no value>", missingkey=zero or not.
+func blankMissing(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			blankMissing(tree, child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			call := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos}
+			call.Args = []parse.Node{parse.NewIdentifier("blank").SetTree(tree).SetPos(n.Pos)}
+			n.Pipe.Cmds = append(n.Pipe.Cmds, call)
+		}
+	case *parse.IfNode:
+		blankMissing(tree, n.List)
+		blankMissing(tree, n.ElseList)
+	case *parse.RangeNode:
+		blankMissing(tree, n.List)
+		blankMissing(tree, n.ElseList)
+	case *parse.WithNode:
+		blankMissing(tree, n.List)
+		blankMissing(tree, n.ElseList)
+	}
+}
+
+// Make runs the templates against data. The text is treated as plain text
+// and rendered for the choir.
+func (nm *NoteMaker) Make(c *choir.Choir, data interface{}) (*choir.Note, error) {
+	label, err := executeTemplate(nm.label, data)
+	if err != nil {
+		return nil, err
+	}
+	sound, err := executeTemplate(nm.sound, data)
+	if err != nil {
+		return nil, err
+	}
+	text, err := executeTemplate(nm.text, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &choir.Note{
+		Label: strings.TrimSpace(label),
+		Sound: strings.TrimSpace(sound),
+		Text:  notetext.Render(notetext.Clean(text, 1000), c.Format),
+		Choir: c,
+	}, nil
+}
+
+func executeTemplate(t *template.Template, data interface{}) (string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// NoteRuleConfig picks out items by the values in them, and says what note
+// to make of them, if any.
+type NoteRuleConfig struct {
+	When   map[string]string
+	If     string
+	Ignore bool
+
+	NoteTemplate
+}
+
+// NoteRule is a compiled NoteRuleConfig.
+type NoteRule struct {
+	When   map[string]string
+	If     *template.Template
+	Ignore bool
+	Notes  *NoteMaker
+}
+
+// NoteRules turns items into notes by the first rule they match. Items no
+// rule matches use the source's own template, unless Unmatched is "ignore".
+type NoteRules struct {
+	Rules     []*NoteRule
+	Notes     *NoteMaker
+	Unmatched string
+}
+
+// CompileRules compiles a source's template and rules. Empty fields in the
+// source's template come from defaults, and empty fields in a rule's come
+// from the source's.
+func CompileRules(base NoteTemplate, rules []NoteRuleConfig, unmatched string, defaults NoteTemplate) (nr NoteRules, err error) {
+	if nr.Notes, err = base.Compile(defaults); err != nil {
+		return
+	}
+	nr.Unmatched = unmatched
+
+	defaults = base.Over(defaults)
+	for i, rc := range rules {
+		rule := &NoteRule{When: rc.When, Ignore: rc.Ignore}
+		if rc.If != "" {
+			if rule.If, err = parseTemplate(fmt.Sprintf("rule %d if", i+1), rc.If); err != nil {
+				return
+			}
+		}
+		if rule.Notes, err = rc.NoteTemplate.Compile(defaults); err != nil {
+			return nr, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		nr.Rules = append(nr.Rules, rule)
+	}
+
+	return nr, nil
+}
+
+// Matches reports whether every path in When has the value given, "*"
+// meaning any value at all, and the If template comes out true.
+func (rule *NoteRule) Matches(data map[string]interface{}) bool {
+	for path, want := range rule.When {
+		found, ok := LookupPath(data, path)
+		if !ok || found == nil {
+			return false
+		}
+		if want != "*" && LookupString(data, path) != want {
+			return false
+		}
+	}
+
+	if rule.If != nil {
+		result, err := executeTemplate(rule.If, data)
+		if err != nil || strings.TrimSpace(result) != "true" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Make runs the item through the rules, the first match wins. It returns
+// nil for items that are ignored.
+func (nr *NoteRules) Make(c *choir.Choir, data map[string]interface{}) (*choir.Note, error) {
+	notes := nr.Notes
+	matched := false
+
+	for _, rule := range nr.Rules {
+		if !rule.Matches(data) {
+			continue
+		}
+		if rule.Ignore {
+			return nil, nil
+		}
+		notes, matched = rule.Notes, true
+		break
+	}
+
+	if !matched && len(nr.Rules) > 0 && nr.Unmatched == "ignore" {
+		return nil, nil
+	}
+
+	return notes.Make(c, data)
+}
+
+// addPayload decodes a JSON payload into data under key, with its top-level
+// fields alongside so templates can say {{.user}}. Anything that isn't JSON
+// is available as text.
+func addPayload(data map[string]interface{}, key string, payload []byte) {
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		data[key] = string(payload)
+		return
+	}
+
+	if fields, ok := decoded.(map[string]interface{}); ok {
+		for k, v := range fields {
+			data[k] = v
+		}
+	}
+	data[key] = decoded
+}
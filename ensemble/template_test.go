@@ -0,0 +1,69 @@
+package ensemble
+
+import (
+	"testing"
+
+	"github.com/dacort/choirmaster/choir"
+	"github.com/dacort/choirmaster/notetext"
+)
+
+func TestTemplateText(t *testing.T) {
+	data := map[string]interface{}{
+		"app":     "api",
+		"user":    "élodie",
+		"message": "got <no value> from the upstream",
+		"nested":  map[string]interface{}{"env": "prod"},
+		"list":    []interface{}{"a", "b"},
+		"empty":   "",
+		"nothing": nil,
+	}
+	tests := []struct {
+		template, want string
+	}{
+		{"{{.app}}", "api"},
+		{"{{.missing}}", ""},
+		{"[{{.missing}}]", "[]"},
+		{"{{.nothing}}", ""},
+		{"{{.nested.env}}/{{.nested.region}}", "prod/"},
+		{"{{.message}}", "got <no value> from the upstream"},
+		{"{{title .user}}", "Élodie"},
+		{"{{title .app}}", "Api"},
+		{"{{title .empty}}", ""},
+		{"{{upper .app}}", "API"},
+		{"{{default \"nobody\" .missing}}", "nobody"},
+		{"{{default \"nobody\" .empty}}", "nobody"},
+		{"{{if .missing}}yes{{else}}no {{.missing}}{{end}}", "no "},
+		{"{{range .list}}{{.}}{{end}}", "ab"},
+		{"{{with .nested}}{{.env}}{{.region}}{{end}}", "prod"},
+		{"{{$a := .app}}{{$a}}", "api"},
+		{"{{truncate 5 .message}}", "got…"},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseTemplate("text", tt.template)
+		if err != nil {
+			t.Fatalf("parseTemplate(%q): %s", tt.template, err)
+		}
+		got, err := executeTemplate(tmpl, data)
+		if err != nil {
+			t.Errorf("executeTemplate(%q): %s", tt.template, err)
+		} else if got != tt.want {
+			t.Errorf("executeTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestNoteMaker(t *testing.T) {
+	c := choir.NewChoir("key")
+	c.Format = notetext.HTML
+	nm, err := NoteTemplate{Label: "Deploy:{{.app}}"}.Compile(NoteTemplate{Sound: "n/0", Text: "{{.user}} & {{.missing}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := nm.Make(c, map[string]interface{}{"app": "api", "user": "<bob>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Label != "Deploy:api" || note.Sound != "n/0" || note.Text != "&lt;bob&gt; &amp;" {
+		t.Errorf("Make = %q %q %q", note.Label, note.Sound, note.Text)
+	}
+}
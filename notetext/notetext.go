@@ -0,0 +1,228 @@
+// Package notetext turns the HTML, excerpts and markup that sources pull out
+// of remote APIs into text that is safe to hand to a choir.
+package notetext
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Ellipsis is appended to any text cut short by Truncate.
+const Ellipsis = "…"
+
+// Format is the markup a sink knows how to display.
+type Format int
+
+const (
+	// HTML is the zero value as choir.io renders note text as HTML.
+	HTML Format = iota
+	Plain
+	Markdown
+)
+
+// ParseFormat maps a config value to a Format, defaulting to HTML.
+func ParseFormat(name string) Format {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "plain", "text":
+		return Plain
+	case "markdown", "md":
+		return Markdown
+	default:
+		return HTML
+	}
+}
+
+func (f Format) String() string {
+	switch f {
+	case Plain:
+		return "plain"
+	case Markdown:
+		return "markdown"
+	default:
+		return "html"
+	}
+}
+
+// Tags that end a line of text when converting from HTML.
+var blockTags = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "tr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "ul": true, "ol": true, "table": true,
+}
+
+// Tags whose contents are never displayed.
+var skipTags = map[string]bool{
+	"script": true, "style": true, "head": true, "title": true,
+}
+
+// FromHTML strips the tags from an HTML fragment, decodes its entities and
+// turns block level elements into line breaks.
+func FromHTML(s string) string {
+	var out strings.Builder
+	skipping := ""
+
+	for len(s) > 0 {
+		// Script and style bodies can hold '<', so jump to their end tag
+		if skipping != "" {
+			end := indexFold(s, "</"+skipping)
+			if end < 0 {
+				break
+			}
+			s = s[end:]
+		}
+
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			if skipping == "" {
+				out.WriteString(html.UnescapeString(s))
+			}
+			break
+		}
+		if skipping == "" {
+			out.WriteString(html.UnescapeString(s[:start]))
+		}
+		s = s[start:]
+
+		// Comments may contain '>' so they get their own terminator
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			// An unterminated tag is just text
+			if skipping == "" {
+				out.WriteString(html.UnescapeString(s))
+			}
+			break
+		}
+
+		name, closing := tagName(s[1:end])
+		s = s[end+1:]
+
+		switch {
+		case skipping != "":
+			if closing && name == skipping {
+				skipping = ""
+			}
+		case skipTags[name] && !closing:
+			skipping = name
+		case blockTags[name]:
+			out.WriteByte('\n')
+		}
+	}
+
+	return out.String()
+}
+
+// indexFold finds needle, which must be lower case ASCII, in s ignoring
+// case. Offsets are into s itself, which lowercasing would shift.
+func indexFold(s, needle string) int {
+	for i := 0; i+len(needle) <= len(s); i++ {
+		j := 0
+		for j < len(needle) && lowerASCII(s[i+j]) == needle[j] {
+			j++
+		}
+		if j == len(needle) {
+			return i
+		}
+	}
+	return -1
+}
+
+func lowerASCII(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// tagName returns the lowercased element name from the inside of a tag and
+// whether it closes an element.
+func tagName(tag string) (name string, closing bool) {
+	tag = strings.TrimSpace(tag)
+	if strings.HasPrefix(tag, "/") {
+		closing = true
+		tag = tag[1:]
+	}
+	end := strings.IndexFunc(tag, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '/'
+	})
+	if end >= 0 {
+		tag = tag[:end]
+	}
+	return strings.ToLower(tag), closing
+}
+
+// Collapse squeezes runs of spaces and tabs into a single space, trims each
+// line and drops blank lines.
+func Collapse(s string) string {
+	lines := strings.Split(s, "\n")
+	kept := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			kept = append(kept, line)
+		}
+	}
+
+	return strings.Join(kept, "\n")
+}
+
+// Truncate shortens s to at most max runes, ending with Ellipsis when it had
+// to cut. It prefers to break on a word boundary.
+func Truncate(s string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	keep := max - utf8.RuneCountInString(Ellipsis)
+	if keep <= 0 {
+		return string([]rune(Ellipsis)[:max])
+	}
+
+	cut := string([]rune(s)[:keep])
+	if space := strings.LastIndexFunc(cut, unicode.IsSpace); space > len(cut)/2 {
+		cut = cut[:space]
+	}
+
+	return strings.TrimRightFunc(cut, unicode.IsSpace) + Ellipsis
+}
+
+// Clean collapses whitespace and truncates plain text to max runes.
+func Clean(s string, max int) string {
+	return Truncate(Collapse(s), max)
+}
+
+// markdownEscaper escapes the characters Markdown would otherwise treat as
+// formatting.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+	`#`, `\#`, `<`, `&lt;`, `>`, `&gt;`,
+)
+
+// Render escapes plain text for the given format and converts its line
+// breaks into that format's markup.
+func Render(s string, f Format) string {
+	switch f {
+	case Plain:
+		return s
+	case Markdown:
+		return strings.Replace(markdownEscaper.Replace(s), "\n", "  \n", -1)
+	default:
+		return strings.Replace(html.EscapeString(s), "\n", "<br />", -1)
+	}
+}
+
+// Join renders each line of plain text on its own line in the given format.
+func Join(lines []string, f Format) string {
+	return Render(strings.Join(lines, "\n"), f)
+}
@@ -0,0 +1,132 @@
+package notetext
+
+import "testing"
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		want Format
+	}{
+		{"", HTML},
+		{"html", HTML},
+		{"plain", Plain},
+		{" Text ", Plain},
+		{"markdown", Markdown},
+		{"MD", Markdown},
+		{"rtf", HTML},
+	}
+	for _, tt := range tests {
+		if got := ParseFormat(tt.name); got != tt.want {
+			t.Errorf("ParseFormat(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"<b>bold</b> &amp; <i>italic</i>", "bold & italic"},
+		{"one<br>two<br/>three", "one\ntwo\nthree"},
+		{"<p>first</p><p>second</p>", "\nfirst\n\nsecond\n"},
+		{"<ul><li>a</li><li>b</li></ul>", "\n\na\n\nb\n\n"},
+		{"before<script>if (a < b) { x() }</script>after", "beforeafter"},
+		{"a<STYLE>p > b {}</STYLE>b", "ab"},
+		{"x<!-- a > b -->y", "xy"},
+		{"1 < 2", "1 < 2"},
+		{"unterminated <b", "unterminated <b"},
+		{"<script>never closed", ""},
+		{"İstanbul<script>x</script>İzmir", "İstanbulİzmir"},
+		{"<script>ȺȺ</script><b>after</b>", "after"},
+		{"<title>İstanbul</TITLE>body", "body"},
+		{"&lt;tag&gt; &quot;q&quot; &#39;s&#39;", `<tag> "q" 's'`},
+	}
+	for _, tt := range tests {
+		if got := FromHTML(tt.in); got != tt.want {
+			t.Errorf("FromHTML(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"  a   b\t\tc  ", "a b c"},
+		{"a\n\n  \nb", "a\nb"},
+		{"\n one \n two \n", "one\ntwo"},
+	}
+	for _, tt := range tests {
+		if got := Collapse(tt.in); got != tt.want {
+			t.Errorf("Collapse(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"no limit at all", 0, "no limit at all"},
+		{"the quick brown fox jumps", 12, "the quick…"},
+		{"abcdefghijklmnop", 6, "abcde…"},
+		{"héllo wörld ünïcode", 9, "héllo…"},
+		{"abc", 1, "…"},
+		{"a b", 2, "a…"},
+	}
+	for _, tt := range tests {
+		if got := Truncate(tt.in, tt.max); got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	if got := Clean("  lots   of\n\n space here ", 14); got != "lots of…" {
+		t.Errorf("Clean = %q", got)
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		in   string
+		f    Format
+		want string
+	}{
+		{"a < b & c\nnext", HTML, "a &lt; b &amp; c<br />next"},
+		{"a < b & c\nnext", Plain, "a < b & c\nnext"},
+		{"*bold* _it_ [x](y) #1\nnext", Markdown, `\*bold\* \_it\_ \[x\](y) \#1` + "  \nnext"},
+		{"<b>", Markdown, "&lt;b&gt;"},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.in, tt.f); got != tt.want {
+			t.Errorf("Render(%q, %s) = %q, want %q", tt.in, tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	lines := []string{"one & two", "three"}
+	tests := []struct {
+		f    Format
+		want string
+	}{
+		{HTML, "one &amp; two<br />three"},
+		{Plain, "one & two\nthree"},
+		{Markdown, "one & two  \nthree"},
+	}
+	for _, tt := range tests {
+		if got := Join(lines, tt.f); got != tt.want {
+			t.Errorf("Join(%s) = %q, want %q", tt.f, got, tt.want)
+		}
+	}
+	if got := Join(nil, HTML); got != "" {
+		t.Errorf("Join(nil) = %q", got)
+	}
+}